@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gopkg.in/yaml.v2"
+)
+
+//
+// app owns the config and the modules built from it.  A reload reads the config again, and
+// only stops and restarts the modules whose part of the config changed.  The broker
+// connections are shared by everything and never touched, so changing brokers still needs a
+// restart.
+//
+type app struct {
+	cfgPath string
+	bmux    RootBrokerMux
+
+	// Reloads can come in from SIGHUP and MQTT at the same time
+	lock    sync.Mutex
+	cfg     Config
+	modules map[string]*moduleScope
+
+	// Set up by the homeassistant module and used by the ones after it
+	ha *haDiscovery
+}
+
+// appModule is a chunk of the config and how to start it.  Modules are started in order and
+// anything that depends on a module that changed gets restarted too.  The list comes from the
+// config, since the matrix has a module per source per display.
+type appModule struct {
+	name  string
+	deps  []string
+	cfg   interface{}
+	start func(a *app, scope *moduleScope)
+}
+
+func appModules(cfg *Config) []appModule {
+	modules := []appModule{
+		{
+			name: "homeassistant",
+			cfg:  cfg.HomeAssistant,
+			start: func(a *app, scope *moduleScope) {
+				a.ha = newHADiscovery(scope, a.cfg.HomeAssistant)
+			},
+		},
+		{
+			name: "sdr",
+			deps: []string{"homeassistant"},
+			cfg:  cfg.SDR,
+			start: func(a *app, scope *moduleScope) {
+				// The SDR code scribbles on its config, so give each one a copy
+				for _, cfg := range a.cfg.SDR {
+					sdrCfg := cfg
+					initSDR(scope, &sdrCfg, a.ha)
+				}
+			},
+		},
+	}
+	modules = append(modules, matrixModules(cfg.Matrix)...)
+	return append(modules,
+		appModule{
+			name: "emulator",
+			cfg:  cfg.Emulator,
+			start: func(a *app, scope *moduleScope) {
+				initEmulator(scope, a.cfg.Emulator)
+			},
+		},
+		appModule{
+			name: "device",
+			deps: []string{"homeassistant"},
+			cfg:  cfg.DeviceMgmt,
+			start: func(a *app, scope *moduleScope) {
+				runDeviceMgmt(scope, a.cfg.DeviceMgmt, a.ha, a.builtins())
+			},
+		},
+	)
+}
+
+// reloadReport is published to device/reload after every reload attempt
+type reloadReport struct {
+	OK        bool     `json:"ok"`
+	Time      string   `json:"time"`
+	Restarted []string `json:"restarted"`
+	Error     string   `json:"error,omitempty"`
+}
+
+//
+// Init.  Startup is just a reload where everything changed.
+//
+func newApp(cfgPath string) (*app, error) {
+	a := &app{
+		cfgPath: cfgPath,
+		modules: make(map[string]*moduleScope),
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.validateConfig(&cfg); err != nil {
+		return nil, err
+	}
+	a.cfg = cfg
+
+	applyDebug(cfg.Debug)
+	logForward.start()
+
+	// The online/offline status sticks with the device topic we started with
+	statusTopic := ""
+	if len(cfg.DeviceMgmt.Topic) > 0 {
+		statusTopic = cfg.DeviceMgmt.Topic + "status"
+	}
+	a.bmux = newBrokerMux(cfg.Brokers, statusTopic)
+
+	for _, module := range appModules(&a.cfg) {
+		a.startModule(module)
+	}
+
+	return a, nil
+}
+
+func (a *app) startModule(module appModule) {
+	log.Infof("module: %s: starting", module.name)
+	scope := newModuleScope(a.bmux, module.name)
+	a.modules[module.name] = scope
+	module.start(a, scope)
+}
+
+//
+// reload re-reads the config and swaps out whatever changed.  Nothing is touched unless the
+// whole config parses and validates.
+//
+func (a *app) reload() reloadReport {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	report := reloadReport{Time: time.Now().Format(time.RFC3339), Restarted: []string{}}
+
+	cfg, err := loadConfig(a.cfgPath)
+	if err == nil {
+		err = a.validateConfig(&cfg)
+	}
+	if err == nil && !reflect.DeepEqual(cfg.Brokers, a.cfg.Brokers) {
+		err = errors.New("brokers changed, restart required")
+	}
+	if err != nil {
+		log.Errorf("reload: %v", err)
+		report.Error = err.Error()
+		a.publishReload(report)
+		return report
+	}
+
+	// Leave the level alone unless debug changed, since it may have been set by loglevel
+	if cfg.Debug != a.cfg.Debug {
+		applyDebug(cfg.Debug)
+	}
+
+	// Figure out what changed, including anything that depends on something that changed.
+	// Modules that are new count as changed, and ones that went away just get stopped.
+	oldModules := appModules(&a.cfg)
+	oldCfgs := make(map[string]interface{}, len(oldModules))
+	for _, module := range oldModules {
+		oldCfgs[module.name] = module.cfg
+	}
+
+	modules := appModules(&cfg)
+	changed := make(map[string]bool)
+	for _, module := range modules {
+		oldCfg, ok := oldCfgs[module.name]
+		changed[module.name] = !ok || !reflect.DeepEqual(oldCfg, module.cfg)
+		for _, dep := range module.deps {
+			if changed[dep] {
+				changed[module.name] = true
+			}
+		}
+	}
+
+	// Stop in reverse so nothing is using a module that's already gone
+	for i := len(oldModules) - 1; i >= 0; i-- {
+		name := oldModules[i].name
+		if stillThere, ok := changed[name]; !ok || stillThere {
+			a.modules[name].Stop()
+			delete(a.modules, name)
+		}
+	}
+
+	a.cfg = cfg
+	for _, module := range modules {
+		if changed[module.name] {
+			a.startModule(module)
+			report.Restarted = append(report.Restarted, module.name)
+		}
+	}
+
+	log.Infof("reload: restarted %v", report.Restarted)
+	report.OK = true
+	a.publishReload(report)
+	return report
+}
+
+//
+// shutdown stops every module, which kills rtl_433 and the job runners, and then lets the
+// brokers finish up what was already published before disconnecting
+//
+func (a *app) shutdown(timeout time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	modules := appModules(&a.cfg)
+	for i := len(modules) - 1; i >= 0; i-- {
+		if scope, ok := a.modules[modules[i].name]; ok {
+			scope.Stop()
+		}
+	}
+
+	a.bmux.Shutdown(timeout)
+}
+
+func (a *app) publishReload(report reloadReport) {
+	if len(a.cfg.DeviceMgmt.Topic) == 0 {
+		return
+	}
+
+	out, err := json.Marshal(report)
+	if err != nil {
+		log.Errorf("reload: %v", err)
+		return
+	}
+
+	t := a.bmux.Publish(a.cfg.DeviceMgmt.Topic+"reload", 1, false, out)
+	t.WaitTimeout(10 * time.Second)
+	if t.Error() != nil {
+		log.Errorf("reload: %v", t.Error())
+	}
+}
+
+// builtins are the device commands that are handled in here
+func (a *app) builtins() map[string]deviceBuiltin {
+	return map[string]deviceBuiltin{
+		"reload": func(args map[string]string) (string, error) {
+			// The reload may restart the device module, and with it this command, so don't
+			// wait around for it.  The result goes to device/reload.
+			go a.reload()
+			return "reloading", nil
+		},
+		"loglevel": func(args map[string]string) (string, error) {
+			level, err := log.ParseLevel(args["level"])
+			if err != nil {
+				return "", err
+			}
+			log.SetLevel(level)
+			log.Infof("log: level is now %s", level)
+			return level.String(), nil
+		},
+	}
+}
+
+//
+// Config loading and checking
+//
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+//
+// validateConfig catches the mistakes that would otherwise only show up as log spam once
+// things are running.  It doesn't try to check every topic, just the ones everything hangs off of.
+//
+func (a *app) validateConfig(cfg *Config) error {
+	var problems []string
+
+	brokers := make(map[string]bool)
+	for _, broker := range cfg.Brokers {
+		if brokers[broker.Name] {
+			problems = append(problems, "duplicate broker "+broker.Name)
+		}
+		brokers[broker.Name] = true
+	}
+
+	checkTopic := func(what string, topic string) {
+		if len(topic) == 0 {
+			return
+		}
+		if broker, _ := splitMuxTopic(topic); !brokers[broker] {
+			problems = append(problems, fmt.Sprintf("%s: unknown broker in %s", what, topic))
+		}
+	}
+
+	checkTopic("homeassistant", cfg.HomeAssistant.Prefix)
+	checkTopic("device", cfg.DeviceMgmt.Topic)
+	for _, sdr := range cfg.SDR {
+		checkTopic("sdr", sdr.Topic)
+		checkTopic("sdr", sdr.Discovery.Topic)
+		checkTopic("sdr", sdr.EventTopic)
+		checkTopic("sdr", sdr.StatsTopic)
+	}
+	checkTopic("matrix", cfg.Matrix.Prefix)
+	for _, topic := range cfg.Emulator.Topics {
+		checkTopic("emulator", topic)
+	}
+
+	// Checking compiles the patterns into the command's own copy of params, so cfg is untouched
+	builtins := a.builtins()
+	for _, command := range cfg.DeviceMgmt.Commands {
+		if err := checkCommand(&command, builtins); err != nil {
+			problems = append(problems, "command: "+err.Error())
+		}
+	}
+
+	sdrNames := make(map[string]bool)
+	sdrDevices := make(map[string]bool)
+	for _, sdr := range cfg.SDR {
+		if len(sdr.Name) == 0 && len(cfg.SDR) > 1 {
+			problems = append(problems, "sdr: every entry needs a name when there is more than one")
+		} else if sdrNames[sdr.Name] {
+			problems = append(problems, "sdr: duplicate name "+sdr.Name)
+		}
+		sdrNames[sdr.Name] = true
+
+		if err := checkSDRModels(sdr.Models); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := checkSDRSensors(sdr.Sensors); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if sdr.SilentMinutes < 0 {
+			problems = append(problems, "sdr: "+sdr.Name+": silentMinutes can't be negative")
+		}
+
+		// Two rtl_433s can't share a dongle, and no device means the first one
+		if len(sdr.Topic) == 0 {
+			continue
+		}
+		if len(sdr.Replay.File) > 0 {
+			if err := sdr.Replay.check(); err != nil {
+				problems = append(problems, fmt.Sprintf("sdr: %s: replay: %v", sdr.Name, err))
+			}
+			continue
+		}
+		if err := sdr.RTL433.check(); err != nil {
+			problems = append(problems, fmt.Sprintf("sdr: %s: %v", sdr.Name, err))
+		}
+		device := sdr.RTL433.Device
+		if len(device) == 0 {
+			device = "0"
+		}
+		if sdrDevices[device] {
+			problems = append(problems, fmt.Sprintf("sdr: %s: device %s is already in use", sdr.Name, device))
+		}
+		sdrDevices[device] = true
+	}
+
+	if len(cfg.DeviceMgmt.Log.Level) > 0 {
+		if _, err := log.ParseLevel(cfg.DeviceMgmt.Log.Level); err != nil {
+			problems = append(problems, "device: log: "+err.Error())
+		}
+	}
+
+	// Display names end up in module names, so the top level one counts too.  It can only be
+	// shared with if it has a prefix, though.
+	top := cfg.Matrix.Name
+	if len(top) == 0 {
+		top = "default"
+	}
+	names := map[string]bool{top: len(cfg.Matrix.Prefix) > 0}
+	for _, display := range cfg.Matrix.Displays {
+		if len(display.Prefix) == 0 {
+			problems = append(problems, "display "+display.Name+": no prefix")
+		}
+		if _, ok := names[display.Name]; ok {
+			problems = append(problems, "display "+display.Name+": duplicate name")
+		}
+		names[display.Name] = true
+		checkTopic("display "+display.Name, display.Prefix)
+	}
+	for _, shared := range cfg.Matrix.Shared {
+		for _, name := range shared.Displays {
+			if !names[name] {
+				problems = append(problems, "shared: unknown display "+name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func applyDebug(debug bool) {
+	if debug {
+		log.Infof("DEBUG")
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -26,13 +27,36 @@ type BrokerConfig struct {
 type BrokerMux interface {
 	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
 	Subscribe(topic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) mqtt.Token
+
+	// Scope returns a BrokerMux that remembers what it subscribed to, so whoever is using it
+	// can drop all of their subscriptions at once without touching anyone else's
+	Scope() ScopedBrokerMux
+}
+
+// ScopedBrokerMux is a BrokerMux that can be closed
+type ScopedBrokerMux interface {
+	BrokerMux
+	Close()
+}
+
+// RootBrokerMux is the one that owns the connections, and is the only one that can shut them down
+type RootBrokerMux interface {
+	BrokerMux
+	Shutdown(timeout time.Duration)
 }
 
 //
-// Init
+// Init.  If statusTopic is set, it gets a retained "online" whenever we connect and "offline"
+// when we go away, either from Shutdown or from the broker noticing we died (the will).
 //
-func newBrokerMux(cfg []BrokerConfig) BrokerMux {
-	bmux := &brokerMuxImpl{brokers: make(map[string]mqtt.Client)}
+func newBrokerMux(cfg []BrokerConfig, statusTopic string) RootBrokerMux {
+	bmux := &brokerMuxImpl{
+		brokers:     make(map[string]mqtt.Client),
+		subs:        make(map[string][]*muxSubscription),
+		pending:     make(map[mqtt.Token]bool),
+		statusTopic: statusTopic,
+	}
+	statusBroker, status := splitMuxTopic(statusTopic)
 
 	for _, broker := range cfg {
 		opts := mqtt.NewClientOptions()
@@ -56,6 +80,14 @@ func newBrokerMux(cfg []BrokerConfig) BrokerMux {
 		opts.OnConnect = connectHandler
 		opts.OnConnectionLost = connectLostHandler
 
+		if len(statusTopic) > 0 && broker.Name == statusBroker {
+			opts.SetWill(status, statusOffline, 1, true)
+			opts.OnConnect = func(client mqtt.Client) {
+				connectHandler(client)
+				client.Publish(status, 1, true, statusOnline)
+			}
+		}
+
 		//
 		// We block if any of the brokers are down.  They can bounce all they want after we connect, we can't
 		// start until they are up.  Tnis is not the end of the world since it is not like we can do a ton
@@ -89,31 +121,213 @@ var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err
 	log.Infof("MQTT: disconnected: %s: %v", r.ClientID(), err)
 }
 
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
 //
-// Implementation
+// Implementation.  paho only keeps one callback per topic filter, so we keep our own list of
+// callbacks per mux topic and only subscribe/unsubscribe with the broker on the first/last one.
+// Publishes that haven't finished yet are kept around so Shutdown can wait for them.
 //
 type brokerMuxImpl struct {
-	brokers map[string]mqtt.Client
+	brokers     map[string]mqtt.Client
+	statusTopic string
+
+	lock    sync.Mutex
+	subs    map[string][]*muxSubscription
+	pending map[mqtt.Token]bool
 }
 
+type muxSubscription struct {
+	muxTopic string
+	callback func(client mqtt.Client, msg mqtt.Message)
+}
+
+// Publish doesn't log, since the log forwarder publishes through it.  Anything added here
+// that does needs logForwardSkip set.
 func (bmux *brokerMuxImpl) Publish(muxTopic string, qos byte, retained bool, payload interface{}) mqtt.Token {
 	broker, topic := splitMuxTopic(muxTopic)
 	if client, ok := bmux.brokers[broker]; ok {
-		return client.Publish(topic, qos, retained, payload)
+		token := client.Publish(topic, qos, retained, payload)
+		bmux.trackPublish(token)
+		return token
 	}
 	return newErrorToken(broker + " is not a valid broker")
 }
 
+// trackPublish remembers the token until it is done, and forgets any others that finished
+func (bmux *brokerMuxImpl) trackPublish(token mqtt.Token) {
+	bmux.lock.Lock()
+	defer bmux.lock.Unlock()
+
+	for t := range bmux.pending {
+		select {
+		case <-t.Done():
+			delete(bmux.pending, t)
+		default:
+		}
+	}
+
+	select {
+	case <-token.Done():
+	default:
+		bmux.pending[token] = true
+	}
+}
+
+//
+// Shutdown waits up to timeout for publishes to finish, says we're offline and disconnects.
+// Everything using the mux should already be stopped, since anything published after this
+// goes nowhere.
+//
+func (bmux *brokerMuxImpl) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	bmux.lock.Lock()
+	pending := &multiToken{}
+	for t := range bmux.pending {
+		pending.tokens = append(pending.tokens, t)
+	}
+	bmux.pending = make(map[mqtt.Token]bool)
+	bmux.lock.Unlock()
+
+	log.Infof("bmux: shutdown: waiting on %d publishes", len(pending.tokens))
+	if !pending.WaitTimeout(time.Until(deadline)) {
+		log.Errorf("bmux: shutdown: gave up on publishes")
+	}
+
+	// A clean disconnect means the broker won't send the will, so send it ourselves
+	if len(bmux.statusTopic) > 0 {
+		t := bmux.Publish(bmux.statusTopic, 1, true, statusOffline)
+		remaining := time.Until(deadline)
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		if !t.WaitTimeout(remaining) || t.Error() != nil {
+			log.Errorf("bmux: shutdown: status: %v", t.Error())
+		}
+	}
+
+	for name, client := range bmux.brokers {
+		log.Infof("bmux: disconnect: %s", name)
+		client.Disconnect(250)
+	}
+}
+
 func (bmux *brokerMuxImpl) Subscribe(muxTopic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) mqtt.Token {
+	_, token := bmux.subscribe(muxTopic, qos, callback)
+	return token
+}
+
+func (bmux *brokerMuxImpl) Scope() ScopedBrokerMux {
+	return &scopedBrokerMux{parent: bmux}
+}
+
+func (bmux *brokerMuxImpl) subscribe(muxTopic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) (*muxSubscription, mqtt.Token) {
 	broker, topic := splitMuxTopic(muxTopic)
-	if client, ok := bmux.brokers[broker]; ok {
+	client, ok := bmux.brokers[broker]
+	if !ok {
+		return nil, newErrorToken(broker + " is not a valid broker")
+	}
+
+	sub := &muxSubscription{muxTopic: muxTopic, callback: callback}
+
+	bmux.lock.Lock()
+	defer bmux.lock.Unlock()
+
+	existing := bmux.subs[muxTopic]
+	bmux.subs[muxTopic] = append(existing, sub)
+
+	// Subscribing again is how the new one gets the retained message.  The broker sends it to
+	// the whole topic, so everyone already there sees it twice, but it's the same state.
+	if len(existing) > 0 {
+		log.Debugf("bmux: subscribe: %s:%s (shared)", broker, topic)
+	} else {
 		log.Debugf("bmux: subscribe: %s:%s", broker, topic)
-		return client.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
-			wrappedMsg := &mqttMessageWrapper{msg: msg, topic: broker + ":" + msg.Topic()}
-			callback(client, wrappedMsg)
-		})
 	}
-	return newErrorToken(broker + " is not a valid broker")
+	return sub, client.Subscribe(topic, qos, bmux.dispatcher(broker, muxTopic))
+}
+
+// dispatcher hands every message on a topic to everyone subscribed to it
+func (bmux *brokerMuxImpl) dispatcher(broker string, muxTopic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		wrappedMsg := &mqttMessageWrapper{msg: msg, topic: broker + ":" + msg.Topic()}
+
+		bmux.lock.Lock()
+		callbacks := make([]*muxSubscription, len(bmux.subs[muxTopic]))
+		copy(callbacks, bmux.subs[muxTopic])
+		bmux.lock.Unlock()
+
+		for _, s := range callbacks {
+			s.callback(client, wrappedMsg)
+		}
+	}
+}
+
+func (bmux *brokerMuxImpl) unsubscribe(sub *muxSubscription) {
+	broker, topic := splitMuxTopic(sub.muxTopic)
+
+	bmux.lock.Lock()
+	defer bmux.lock.Unlock()
+
+	remaining := make([]*muxSubscription, 0, len(bmux.subs[sub.muxTopic]))
+	for _, s := range bmux.subs[sub.muxTopic] {
+		if s != sub {
+			remaining = append(remaining, s)
+		}
+	}
+
+	if len(remaining) > 0 {
+		bmux.subs[sub.muxTopic] = remaining
+		return
+	}
+
+	delete(bmux.subs, sub.muxTopic)
+	if client, ok := bmux.brokers[broker]; ok {
+		log.Debugf("bmux: unsubscribe: %s:%s", broker, topic)
+		client.Unsubscribe(topic)
+	}
+}
+
+//
+// scopedBrokerMux just tracks subscriptions so they can be dropped in one go
+//
+type scopedBrokerMux struct {
+	parent *brokerMuxImpl
+
+	lock sync.Mutex
+	subs []*muxSubscription
+}
+
+func (s *scopedBrokerMux) Publish(muxTopic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return s.parent.Publish(muxTopic, qos, retained, payload)
+}
+
+func (s *scopedBrokerMux) Subscribe(muxTopic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) mqtt.Token {
+	sub, token := s.parent.subscribe(muxTopic, qos, callback)
+	if sub != nil {
+		s.lock.Lock()
+		s.subs = append(s.subs, sub)
+		s.lock.Unlock()
+	}
+	return token
+}
+
+func (s *scopedBrokerMux) Scope() ScopedBrokerMux {
+	return s.parent.Scope()
+}
+
+func (s *scopedBrokerMux) Close() {
+	s.lock.Lock()
+	subs := s.subs
+	s.subs = nil
+	s.lock.Unlock()
+
+	for _, sub := range subs {
+		s.parent.unsubscribe(sub)
+	}
 }
 
 func splitMuxTopic(muxTopic string) (string, string) {
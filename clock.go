@@ -0,0 +1,179 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ClockConfig publishes the time and date as text, and optionally as a rendered clock face.
+// Formats are Go time layouts, and default to something sane for 12 or 24 hour time.  Jobs
+// default to every minute, right at the top of the minute.
+type ClockConfig struct {
+	Topic      string       `yaml:"topic"`
+	ImageTopic string       `yaml:"imageTopic"`
+	Jobs       JobRunnerCfg `yaml:"jobs"`
+	Format     string       `yaml:"format"`
+	DateFormat string       `yaml:"dateFormat"`
+	Hour24     bool         `yaml:"hour24"`
+	Timezone   string       `yaml:"timezone"`
+}
+
+const (
+	clockWidth  = 64
+	clockHeight = 32
+)
+
+//
+// Init
+//
+func initClock(scope *moduleScope, mmux MatrixMux, cfg ClockConfig) {
+	if len(cfg.Topic) == 0 && len(cfg.ImageTopic) == 0 {
+		return
+	}
+
+	location := time.Local
+	if len(cfg.Timezone) > 0 {
+		if loc, err := time.LoadLocation(cfg.Timezone); err == nil {
+			location = loc
+		} else {
+			log.Errorf("clock: timezone: %v", err)
+		}
+	}
+
+	if len(cfg.Format) == 0 {
+		cfg.Format = "3:04 PM"
+		if cfg.Hour24 {
+			cfg.Format = "15:04"
+		}
+	}
+	if len(cfg.DateFormat) == 0 {
+		cfg.DateFormat = "Mon Jan 2"
+	}
+
+	jobs := cfg.Jobs
+	if len(jobs.Offsets) == 0 && jobs.RandMax == 0 && jobs.EveryInterval == 0 {
+		jobs = JobRunnerCfg{EveryInterval: 1, Align: true}
+	}
+
+	scope.NewJobRunner("clock", jobs, func() {
+		publishClock(mmux, cfg, time.Now().In(location))
+	}).Run()
+}
+
+func publishClock(mmux MatrixMux, cfg ClockConfig, now time.Time) {
+	if len(cfg.Topic) > 0 {
+		lines := []string{now.Format(cfg.Format), now.Format(cfg.DateFormat)}
+		log.Debugf("clock: %v", lines)
+		mmux.PublishText(cfg.Topic, lines)
+	}
+
+	if len(cfg.ImageTopic) > 0 {
+		mmux.PublishImage(cfg.ImageTopic, renderClockFace(now, cfg.Hour24))
+	}
+}
+
+//
+// renderClockFace draws an analog clock on the left half and the hours and minutes stacked
+// on the right half.  The hands are just lines, which is about all 32 pixels allows.
+//
+func renderClockFace(now time.Time, hour24 bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, clockWidth, clockHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	face := color.NRGBA{R: 0x40, G: 0x40, B: 0x80, A: 0xff}
+	hourHand := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	minuteHand := color.NRGBA{R: 0x00, G: 0xc0, B: 0xff, A: 0xff}
+
+	cx, cy, radius := 15.5, 15.5, 15.0
+
+	// Rim and hour ticks
+	for deg := 0; deg < 360; deg += 3 {
+		x, y := polar(cx, cy, radius, float64(deg))
+		img.Set(x, y, face)
+	}
+	for hour := 0; hour < 12; hour++ {
+		x0, y0 := polar(cx, cy, radius-3, float64(hour*30))
+		x1, y1 := polar(cx, cy, radius-1, float64(hour*30))
+		drawLine(img, x0, y0, x1, y1, face)
+	}
+
+	// Hands
+	minutes := float64(now.Minute()) + float64(now.Second())/60
+	hours := float64(now.Hour()%12) + minutes/60
+	x, y := polar(cx, cy, radius-7, hours*30)
+	drawLine(img, int(cx), int(cy), x, y, hourHand)
+	x, y = polar(cx, cy, radius-3, minutes*6)
+	drawLine(img, int(cx), int(cy), x, y, minuteHand)
+
+	// Digital on the right
+	hourText := now.Format("3")
+	if hour24 {
+		hourText = now.Format("15")
+	}
+	drawText(img, 40, 0, hourHand, hourText)
+	drawText(img, 40, 16, minuteHand, now.Format("04"))
+
+	return img
+}
+
+// polar returns the pixel at the given angle (clockwise from 12) and distance from the center
+func polar(cx float64, cy float64, r float64, degrees float64) (int, int) {
+	rad := degrees * math.Pi / 180
+	return int(math.Round(cx + r*math.Sin(rad))), int(math.Round(cy - r*math.Cos(rad)))
+}
+
+// drawLine is plain old Bresenham
+func drawLine(img *image.NRGBA, x0 int, y0 int, x1 int, y1 int, c color.Color) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err = err + dy
+			x0 = x0 + sx
+		}
+		if e2 <= dx {
+			err = err + dx
+			y0 = y0 + sy
+		}
+	}
+}
+
+// drawText draws a single line with basicfont, with x/y being the top left corner
+func drawText(img *image.NRGBA, x int, y int, c color.Color, text string) {
+	face := basicfont.Face7x13
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y+face.Ascent),
+	}
+	d.DrawString(text)
+}
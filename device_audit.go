@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceAuditConfig keeps a local copy of the audit trail in file, as JSON lines.  Once it
+// passes maxSize KB it is rotated to file.1, file.2 and so on, keeping keep of them.
+type DeviceAuditConfig struct {
+	File    string `yaml:"file"`
+	MaxSize int    `yaml:"maxSize"`
+	Keep    int    `yaml:"keep"`
+}
+
+//
+// Every command that comes in gets an audit record, even the ones that get rejected.  Key is
+// who signed it (empty if nobody did) and topic is where the result went.  Commands that
+// don't even parse have no result topic, and get the payload (the last maxOutput bytes of it)
+// instead so there's some record of what was sent.
+//
+type deviceAuditRecord struct {
+	Time       string                 `json:"time"`
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Key        string                 `json:"key,omitempty"`
+	Topic      string                 `json:"topic"`
+	Args       map[string]interface{} `json:"args,omitempty"`
+	Payload    string                 `json:"payload,omitempty"`
+	ExitCode   int                    `json:"exitCode"`
+	DurationMs int64                  `json:"durationMs"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+type auditFile struct {
+	cfg DeviceAuditConfig
+
+	// Commands finish on their own goroutines
+	lock sync.Mutex
+}
+
+func newAuditFile(cfg DeviceAuditConfig) *auditFile {
+	if len(cfg.File) == 0 {
+		return nil
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 1024
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = 3
+	}
+	return &auditFile{cfg: cfg}
+}
+
+func (f *auditFile) write(line []byte) error {
+	if f == nil {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if st, err := os.Stat(f.cfg.File); err == nil && st.Size()+int64(len(line)) > int64(f.cfg.MaxSize)*1024 {
+		f.rotate()
+	}
+
+	out, err := os.OpenFile(f.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = out.Write(line)
+	return err
+}
+
+// rotate shuffles file.N-1 to file.N on down, dropping the oldest
+func (f *auditFile) rotate() {
+	for i := f.cfg.Keep - 1; i >= 1; i-- {
+		os.Rename(f.cfg.File+"."+strconv.Itoa(i), f.cfg.File+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(f.cfg.File, f.cfg.File+".1")
+}
+
+func (dm *deviceMgmt) audit(req deviceCommandRequest, key string, topic string, result deviceCommandResult) {
+	record := deviceAuditRecord{
+		Time:       time.Now().Format(time.RFC3339),
+		ID:         req.ID,
+		Name:       req.Name,
+		Key:        key,
+		Topic:      topic,
+		Args:       req.Args,
+		ExitCode:   result.ExitCode,
+		DurationMs: result.DurationMs,
+		Error:      result.Error,
+	}
+	dm.writeAudit(record)
+}
+
+// auditUnparsed records a command that never made it far enough to have a name or result
+func (dm *deviceMgmt) auditUnparsed(payload []byte, key string, parseErr error) {
+	dm.writeAudit(deviceAuditRecord{
+		Time:     time.Now().Format(time.RFC3339),
+		Key:      key,
+		Payload:  truncateOutput(payload, dm.cfg.MaxOutput),
+		ExitCode: -1,
+		Error:    "parse: " + parseErr.Error(),
+	})
+}
+
+func (dm *deviceMgmt) writeAudit(record deviceAuditRecord) {
+	out, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("audit: %v", err)
+		return
+	}
+
+	if err := dm.auditFile.write(append(out, '\n')); err != nil {
+		log.Errorf("audit: %s: %v", dm.cfg.Audit.File, err)
+	}
+
+	t := dm.bmux.Publish(dm.cfg.Topic+"audit", 1, false, out)
+	t.WaitTimeout(10 * time.Second)
+	if t.Error() != nil {
+		log.Errorf("audit: %v", t.Error())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSign(secret string, msg string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	auth := newDeviceAuth(map[string]string{"phone": "s3cret", "empty": ""}, 0)
+	msg := `{"name":"reboot","ts":1700000000,"nonce":"x1"}`
+	good := testSign("s3cret", msg)
+
+	tests := []struct {
+		name   string
+		signed signedDeviceCommand
+		ok     bool
+	}{
+		{"good", signedDeviceCommand{Key: "phone", Sig: good, Msg: msg}, true},
+		{"upper case hex", signedDeviceCommand{Key: "phone", Sig: strings.ToUpper(good), Msg: msg}, true},
+		{"unknown key", signedDeviceCommand{Key: "laptop", Sig: good, Msg: msg}, false},
+		{"empty secret", signedDeviceCommand{Key: "empty", Sig: testSign("", msg), Msg: msg}, false},
+		{"wrong secret", signedDeviceCommand{Key: "phone", Sig: testSign("guess", msg), Msg: msg}, false},
+		{"tampered msg", signedDeviceCommand{Key: "phone", Sig: good, Msg: msg + " "}, false},
+		{"truncated sig", signedDeviceCommand{Key: "phone", Sig: good[:32], Msg: msg}, false},
+		{"not hex", signedDeviceCommand{Key: "phone", Sig: "zz" + good[2:], Msg: msg}, false},
+		{"no sig", signedDeviceCommand{Key: "phone", Msg: msg}, false},
+	}
+
+	for _, test := range tests {
+		out, err := auth.verify(test.signed)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+		if err == nil && string(out) != msg {
+			t.Errorf("%s: got %s", test.name, out)
+		}
+	}
+}
+
+func TestCheckFresh(t *testing.T) {
+	auth := newDeviceAuth(nil, 60)
+	now := time.Now().Unix()
+
+	// In order, since the nonces stick around
+	tests := []struct {
+		name string
+		key  string
+		req  deviceCommandRequest
+		ok   bool
+	}{
+		{"no ts", "phone", deviceCommandRequest{Nonce: "a"}, false},
+		{"no nonce", "phone", deviceCommandRequest{Timestamp: now}, false},
+		{"now", "phone", deviceCommandRequest{Timestamp: now, Nonce: "a"}, true},
+		{"replay", "phone", deviceCommandRequest{Timestamp: now, Nonce: "a"}, false},
+		{"replay later", "phone", deviceCommandRequest{Timestamp: now + 5, Nonce: "a"}, false},
+		{"other key", "laptop", deviceCommandRequest{Timestamp: now, Nonce: "a"}, true},
+		{"inside skew", "phone", deviceCommandRequest{Timestamp: now - 50, Nonce: "b"}, true},
+		{"stale", "phone", deviceCommandRequest{Timestamp: now - 120, Nonce: "c"}, false},
+		{"future", "phone", deviceCommandRequest{Timestamp: now + 120, Nonce: "d"}, false},
+		{"stale nonce not used", "phone", deviceCommandRequest{Timestamp: now, Nonce: "c"}, true},
+	}
+
+	for _, test := range tests {
+		if err := auth.checkFresh(test.key, test.req); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestCheckFreshForgetsNonces(t *testing.T) {
+	auth := newDeviceAuth(nil, 60)
+	auth.nonces["phone:old"] = time.Now().Add(-3 * time.Minute)
+	auth.nonces["phone:new"] = time.Now()
+
+	if err := auth.checkFresh("phone", deviceCommandRequest{Timestamp: time.Now().Unix(), Nonce: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := auth.nonces["phone:old"]; ok {
+		t.Error("old nonce is still there")
+	}
+	if _, ok := auth.nonces["phone:new"]; !ok {
+		t.Error("new nonce is gone")
+	}
+}
+
+func TestParseSignedCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		ok      bool
+	}{
+		{"signed", `{"key":"phone","sig":"00","msg":"{}"}`, true},
+		{"bare name", `reboot`, false},
+		{"plain json", `{"name":"reboot"}`, false},
+		{"no msg", `{"key":"phone","sig":"00"}`, false},
+		{"no sig", `{"key":"phone","msg":"{}"}`, false},
+	}
+
+	for _, test := range tests {
+		if _, ok := parseSignedCommand([]byte(test.payload)); ok != test.ok {
+			t.Errorf("%s: got %v", test.name, ok)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Commands show up either as a bare name (the old way) or as JSON with an ID so the caller
+// can match up the result.  paho only speaks MQTT 3.1.1, so there is no response topic in
+// the message itself.  Reply is the stand-in for it.  Timestamp and nonce are only used by
+// signed commands.
+//
+type deviceCommandRequest struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Args      map[string]interface{} `json:"args"`
+	Reply     string                 `json:"reply"`
+	Timestamp int64                  `json:"ts"`
+	Nonce     string                 `json:"nonce"`
+}
+
+type deviceCommandResult struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ExitCode   int    `json:"exitCode"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+func parseDeviceCommand(payload []byte) (deviceCommandRequest, error) {
+	var req deviceCommandRequest
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &req); err != nil {
+			return req, err
+		}
+	} else {
+		req.Name = string(trimmed)
+	}
+
+	if len(req.ID) == 0 {
+		req.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	// The ID ends up in a topic, so no wildcards or levels
+	if strings.ContainsAny(req.ID, "/#+") {
+		return req, errors.New("bad id: " + req.ID)
+	}
+
+	return req, nil
+}
+
+//
+// handleCommand runs on its own goroutine for every incoming command
+//
+func (dm *deviceMgmt) handleCommand(payload []byte) {
+	// Signed commands get unwrapped first, and key is who signed it
+	key := ""
+	authErr := ""
+	if signed, ok := parseSignedCommand(payload); ok {
+		msg, err := dm.auth.verify(signed)
+		if err != nil {
+			// The reply topic can't be trusted, but the ID is only used for the default one
+			authErr = err.Error()
+			msg = []byte(signed.Msg)
+		}
+		key = signed.Key
+		payload = msg
+	}
+
+	req, err := parseDeviceCommand(payload)
+	if err != nil {
+		log.Errorf("command: parse: %v", err)
+		dm.auditUnparsed(payload, key, err)
+		return
+	}
+
+	if len(authErr) == 0 && len(key) > 0 {
+		if err := dm.auth.checkFresh(key, req); err != nil {
+			authErr = err.Error()
+		}
+	}
+
+	log.Infof("command: name=%s id=%s key=%s", req.Name, req.ID, key)
+
+	result := deviceCommandResult{ID: req.ID, Name: req.Name, ExitCode: -1}
+
+	// Walk all of the commands and see if the one passed in matches one in the table
+	var command *DeviceCommandConfig
+	for i := range dm.cfg.Commands {
+		if dm.cfg.Commands[i].Name == req.Name {
+			command = &dm.cfg.Commands[i]
+			break
+		}
+	}
+
+	switch {
+	case len(authErr) > 0:
+		result.Error = "auth: " + authErr
+		req.Reply = ""
+	case command == nil:
+		result.Error = "unknown command"
+	case !commandAuthorized(command, key):
+		result.Error = "not authorized"
+	default:
+		if err := dm.limits.start(command); err != nil {
+			result.Error = err.Error()
+			break
+		}
+		if len(command.Builtin) > 0 {
+			runBuiltinCommand(command, dm.builtins[command.Builtin], req.Args, &result)
+		} else {
+			runDeviceCommand(command, req.Args, dm.cfg.MaxOutput, &result)
+		}
+		dm.limits.done(command)
+	}
+
+	if len(result.Error) > 0 {
+		log.Errorf("command: name=%s id=%s error=%s", req.Name, req.ID, result.Error)
+	}
+
+	topic := dm.resultTopic(req)
+	dm.publishCommandResult(topic, result)
+	dm.audit(req, key, topic, result)
+}
+
+// commandAuthorized is true if the command is open to everyone or key is one of the allowed ones
+func commandAuthorized(command *DeviceCommandConfig, key string) bool {
+	if len(command.Auth) == 0 {
+		return true
+	}
+	for _, allowed := range command.Auth {
+		if allowed == key {
+			return true
+		}
+	}
+	return false
+}
+
+func runDeviceCommand(command *DeviceCommandConfig, args map[string]interface{}, maxOutput int, result *deviceCommandResult) {
+	var stdout, stderr bytes.Buffer
+
+	// The command gets its own process group so the timeout can kill everything it started.
+	// Anything left holding stdout would otherwise keep Run waiting, and the slot in use.
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(command))
+	defer cancel()
+
+	var execCommand *exec.Cmd
+	if len(command.Argv) > 0 {
+		argv, err := buildCommandArgv(command, args)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		execCommand = exec.Command(argv[0], argv[1:]...)
+	} else if len(args) > 0 {
+		result.Error = "command takes no args"
+		return
+	} else {
+		execCommand = exec.Command("/bin/bash", "-c", command.CmdLine)
+	}
+	execCommand.Stdout = &stdout
+	execCommand.Stderr = &stderr
+	execCommand.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := execCommand.Start(); err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-execCommand.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err := execCommand.Wait()
+	close(done)
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	result.Stdout = truncateOutput(stdout.Bytes(), maxOutput)
+	result.Stderr = truncateOutput(stderr.Bytes(), maxOutput)
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Error = "timeout"
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	default:
+		result.Error = err.Error()
+	}
+}
+
+// runBuiltinCommand makes a builtin look like any other command, with errors in stderr
+func runBuiltinCommand(command *DeviceCommandConfig, builtin deviceBuiltin, args map[string]interface{}, result *deviceCommandResult) {
+	values, err := checkCommandArgs(command, args)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	start := time.Now()
+	out, err := builtin(values)
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	result.Stdout = out
+	result.ExitCode = 0
+	if err != nil {
+		result.Stderr = err.Error()
+		result.ExitCode = 1
+	}
+}
+
+// truncateOutput keeps the tail of the output since that's where the errors usually are
+func truncateOutput(out []byte, max int) string {
+	if len(out) <= max {
+		return string(out)
+	}
+	return "..." + string(out[len(out)-max:])
+}
+
+// resultTopic is reply if the command gave one, otherwise device/cmd/result/ID.  Replies stay
+// on the broker the command came in on, can't be wildcards, and can't be the command topic,
+// where the result (which has a name) would run the command again.  Anything else gets the
+// default instead.
+func (dm *deviceMgmt) resultTopic(req deviceCommandRequest) string {
+	fallback := dm.cfg.Topic + "cmd/result/" + req.ID
+	if len(req.Reply) == 0 {
+		return fallback
+	}
+
+	broker, _ := splitMuxTopic(dm.cfg.Topic)
+	reply := req.Reply
+	if strings.Contains(reply, ":") {
+		replyBroker, topic := splitMuxTopic(reply)
+		if replyBroker != broker {
+			log.Errorf("command: id=%s: reply %s is not on %s", req.ID, req.Reply, broker)
+			return fallback
+		}
+		reply = topic
+	}
+
+	reply = broker + ":" + reply
+	if strings.HasSuffix(reply, ":") || strings.ContainsAny(reply, "+#") || reply == dm.cfg.Topic+"cmd" {
+		log.Errorf("command: id=%s: bad reply %s", req.ID, req.Reply)
+		return fallback
+	}
+	return reply
+}
+
+func (dm *deviceMgmt) publishCommandResult(topic string, result deviceCommandResult) {
+	out, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("command: result: %v", err)
+		return
+	}
+
+	t := dm.bmux.Publish(topic, 1, false, out)
+	t.WaitTimeout(10 * time.Second)
+	if t.Error() != nil {
+		log.Errorf("command: result: %s: %v", topic, t.Error())
+	}
+}
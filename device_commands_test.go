@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestResultTopic(t *testing.T) {
+	dm := &deviceMgmt{cfg: DeviceMgmtConfig{Topic: "local:device/"}}
+	fallback := "local:device/cmd/result/abc"
+
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"default", "", fallback},
+		{"relative", "phone/results", "local:phone/results"},
+		{"same broker", "local:phone/results", "local:phone/results"},
+		{"other broker", "cloud:phone/results", fallback},
+		{"unknown broker", "phone:results", fallback},
+		{"plus", "phone/+/results", fallback},
+		{"hash", "phone/#", fallback},
+		{"broker only", "local:", fallback},
+		{"command topic", "device/cmd", fallback},
+		{"command topic with broker", "local:device/cmd", fallback},
+		{"under command topic", "device/cmd/mine", "local:device/cmd/mine"},
+	}
+
+	for _, test := range tests {
+		if got := dm.resultTopic(deviceCommandRequest{ID: "abc", Reply: test.reply}); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceHealthConfig controls the health document published to device/health.  Disks are
+// paths to report free space for, and default to just /.  The status of every module goes to
+// device/modules on the same schedule, and right away whenever one of them changes.
+type DeviceHealthConfig struct {
+	Jobs  JobRunnerCfg `yaml:"jobs"`
+	Disks []string     `yaml:"disks"`
+}
+
+// version gets set by the Makefile via -ldflags
+var version = "dev"
+
+var processStart = time.Now()
+
+//
+// The health document.  Anything we can't read (say, not running on a Pi) is just left out.
+//
+type deviceHealth struct {
+	Version       string              `json:"version"`
+	Time          string              `json:"time"`
+	ProcessUptime int64               `json:"processUptime"`
+	OSUptime      int64               `json:"osUptime,omitempty"`
+	Load          []float64           `json:"load,omitempty"`
+	Memory        *healthMemory       `json:"memory,omitempty"`
+	Disks         map[string]diskFree `json:"disks,omitempty"`
+	CPUTemp       float64             `json:"cpuTemp,omitempty"`
+	Throttled     *healthThrottled    `json:"throttled,omitempty"`
+	Runtime       healthRuntime       `json:"runtime"`
+}
+
+type healthMemory struct {
+	TotalKB     uint64 `json:"totalKB"`
+	AvailableKB uint64 `json:"availableKB"`
+}
+
+type diskFree struct {
+	Free  uint64 `json:"free"`
+	Total uint64 `json:"total"`
+}
+
+type healthThrottled struct {
+	Raw   string   `json:"raw"`
+	Flags []string `json:"flags,omitempty"`
+}
+
+type healthRuntime struct {
+	GoVersion  string `json:"goVersion"`
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heapAlloc"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"numGC"`
+}
+
+func initDeviceHealth(scope *moduleScope, baseTopic string, cfg DeviceHealthConfig) {
+	if len(cfg.Disks) == 0 {
+		cfg.Disks = []string{"/"}
+	}
+
+	jobs := cfg.Jobs
+	if len(jobs.Offsets) == 0 && jobs.RandMax == 0 && jobs.EveryInterval == 0 {
+		jobs = JobRunnerCfg{EveryInterval: 5}
+	}
+
+	report := func() {
+		out, err := json.Marshal(collectDeviceHealth(cfg))
+		if err != nil {
+			log.Errorf("health: %v", err)
+			return
+		}
+		t := scope.Publish(baseTopic+"health", 1, true, out)
+		t.WaitTimeout(10 * time.Second)
+		if t.Error() != nil {
+			log.Errorf("health: %v", t.Error())
+		}
+	}
+
+	reportModules := func() {
+		out, err := moduleHealth.marshal()
+		if err != nil {
+			log.Errorf("health: modules: %v", err)
+			return
+		}
+		t := scope.Publish(baseTopic+"modules", 1, true, out)
+		t.WaitTimeout(10 * time.Second)
+		if t.Error() != nil {
+			log.Errorf("health: modules: %v", t.Error())
+		}
+	}
+
+	go report()
+	scope.NewJobRunner("health", jobs, func() {
+		report()
+		reportModules()
+	}).Run()
+
+	go func() {
+		reportModules()
+		for {
+			select {
+			case <-moduleHealth.changed:
+				reportModules()
+			case <-scope.Done():
+				return
+			}
+		}
+	}()
+}
+
+func collectDeviceHealth(cfg DeviceHealthConfig) *deviceHealth {
+	health := &deviceHealth{
+		Version:       version,
+		Time:          time.Now().Format(time.RFC3339),
+		ProcessUptime: int64(time.Since(processStart).Seconds()),
+		Disks:         make(map[string]diskFree),
+	}
+
+	// /proc/uptime is "uptime idle" in seconds
+	if fields := readProcFields("/proc/uptime"); len(fields) > 0 {
+		if up, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			health.OSUptime = int64(up)
+		}
+	}
+
+	// /proc/loadavg starts with the 1, 5 and 15 minute averages
+	if fields := readProcFields("/proc/loadavg"); len(fields) >= 3 {
+		for _, field := range fields[:3] {
+			if load, err := strconv.ParseFloat(field, 64); err == nil {
+				health.Load = append(health.Load, load)
+			}
+		}
+	}
+
+	health.Memory = readMemInfo()
+
+	for _, path := range cfg.Disks {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err == nil {
+			health.Disks[path] = diskFree{
+				Free:  uint64(st.Bavail) * uint64(st.Bsize),
+				Total: uint64(st.Blocks) * uint64(st.Bsize),
+			}
+		}
+	}
+
+	// Millidegrees C
+	if fields := readProcFields("/sys/class/thermal/thermal_zone0/temp"); len(fields) > 0 {
+		if temp, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			health.CPUTemp = temp / 1000
+		}
+	}
+
+	health.Throttled = readThrottled()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	health.Runtime = healthRuntime{
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Sys:        mem.Sys,
+		NumGC:      mem.NumGC,
+	}
+
+	return health
+}
+
+func readProcFields(path string) []string {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(raw))
+}
+
+func readMemInfo() *healthMemory {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mem := &healthMemory{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			mem.TotalKB = value
+		case "MemAvailable:":
+			mem.AvailableKB = value
+		}
+	}
+	return mem
+}
+
+//
+// Pi throttling bits.  Newer kernels have it in sysfs, otherwise ask vcgencmd.  Not being
+// on a Pi at all just means no throttled section.
+//
+var throttledBits = []struct {
+	bit  uint
+	name string
+}{
+	{0, "underVoltage"},
+	{1, "freqCapped"},
+	{2, "throttled"},
+	{3, "softTempLimit"},
+	{16, "underVoltageOccurred"},
+	{17, "freqCappedOccurred"},
+	{18, "throttledOccurred"},
+	{19, "softTempLimitOccurred"},
+}
+
+func readThrottled() *healthThrottled {
+	raw := ""
+	if fields := readProcFields("/sys/devices/platform/soc/soc:firmware/get_throttled"); len(fields) > 0 {
+		raw = fields[0]
+	} else if out, err := exec.Command("vcgencmd", "get_throttled").Output(); err == nil {
+		// throttled=0x50000
+		raw = strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	} else {
+		return nil
+	}
+
+	value, err := strconv.ParseUint(strings.TrimPrefix(raw, "0x"), 16, 32)
+	if err != nil {
+		return nil
+	}
+
+	throttled := &healthThrottled{Raw: raw}
+	for _, b := range throttledBits {
+		if value&(1<<b.bit) != 0 {
+			throttled.Flags = append(throttled.Flags, b.name)
+		}
+	}
+	return throttled
+}
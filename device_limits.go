@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Commands that don't set a timeout get killed after this long
+const defaultCommandTimeout = 60 * time.Second
+
+//
+// commandLimits keeps repeated messages from starting a pile of copies of the same command.
+// maxConcurrent of 1 is single instance mode, and cooldown is the minimum time between starts.
+//
+type commandLimits struct {
+	lock      sync.Mutex
+	running   map[string]int
+	lastStart map[string]time.Time
+}
+
+func newCommandLimits() *commandLimits {
+	return &commandLimits{
+		running:   make(map[string]int),
+		lastStart: make(map[string]time.Time),
+	}
+}
+
+// start returns an error if the command can't run right now, otherwise done must be called
+func (l *commandLimits) start(command *DeviceCommandConfig) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if command.MaxConcurrent > 0 && l.running[command.Name] >= command.MaxConcurrent {
+		return errors.New("busy")
+	}
+
+	now := time.Now()
+	if command.Cooldown > 0 {
+		if last, ok := l.lastStart[command.Name]; ok {
+			left := time.Duration(command.Cooldown)*time.Second - now.Sub(last)
+			if left > 0 {
+				return fmt.Errorf("cooldown, %ds left", int(left.Seconds()+0.5))
+			}
+		}
+	}
+
+	l.running[command.Name]++
+	l.lastStart[command.Name] = now
+	return nil
+}
+
+func (l *commandLimits) done(command *DeviceCommandConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running[command.Name]--
+}
+
+func commandTimeout(command *DeviceCommandConfig) time.Duration {
+	if command.Timeout > 0 {
+		return time.Duration(command.Timeout) * time.Second
+	}
+	return defaultCommandTimeout
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"os/exec"
 	"strconv"
-	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -11,59 +9,126 @@ import (
 )
 
 // DeviceMgmtConfig supports posting some stuff to device/+ as well as listening for
-// commands on device/cmd.
+// commands on device/cmd.  Results of commands go to device/cmd/result/ID unless the
+// command asks for them somewhere else.  Secrets are the shared keys for signed commands,
+// and signed commands older or newer than maxSkew seconds are rejected.  Every command is
+// logged to device/audit, and to a local file if one is configured.
 type DeviceMgmtConfig struct {
-	Topic    string `yaml:"topic"`
-	Commands []struct {
-		Name    string `yaml:"name"`
-		CmdLine string `yaml:"cmdline"`
-	}
+	Topic     string                `yaml:"topic"`
+	MaxOutput int                   `yaml:"maxOutput"`
+	Secrets   map[string]string     `yaml:"secrets"`
+	MaxSkew   int                   `yaml:"maxSkew"`
+	Commands  []DeviceCommandConfig `yaml:"commands"`
+	Health    DeviceHealthConfig    `yaml:"health"`
+	Log       DeviceLogConfig       `yaml:"log"`
+	Audit     DeviceAuditConfig     `yaml:"audit"`
+}
+
+// DeviceCommandConfig maps a command name to what we actually run.  Cmdline goes through
+// bash, while argv is run directly and can have {param} placeholders filled in from the
+// args in the command.  Builtin runs something in here instead, like reload.  If auth lists
+// any secrets, the command must be signed by one of them.  Commands are killed after timeout
+// seconds, at most maxConcurrent copies run at once (1 for single instance, 0 for no limit),
+// and a new one can't start until cooldown seconds after the last one started.
+type DeviceCommandConfig struct {
+	Name          string               `yaml:"name"`
+	CmdLine       string               `yaml:"cmdline"`
+	Argv          []string             `yaml:"argv"`
+	Builtin       string               `yaml:"builtin"`
+	Params        []DeviceCommandParam `yaml:"params"`
+	Auth          []string             `yaml:"auth"`
+	Timeout       int                  `yaml:"timeout"`
+	MaxConcurrent int                  `yaml:"maxConcurrent"`
+	Cooldown      int                  `yaml:"cooldown"`
 }
 
-func runDeviceMgmt(bmux BrokerMux, cfg DeviceMgmtConfig) {
+// deviceBuiltin gets the checked args and returns what goes in stdout
+type deviceBuiltin func(args map[string]string) (string, error)
+
+// deviceMgmt is everything the command handlers need
+type deviceMgmt struct {
+	bmux      BrokerMux
+	cfg       DeviceMgmtConfig
+	auth      *deviceAuth
+	builtins  map[string]deviceBuiltin
+	limits    *commandLimits
+	auditFile *auditFile
+}
+
+func runDeviceMgmt(scope *moduleScope, cfg DeviceMgmtConfig, ha *haDiscovery, builtins map[string]deviceBuiltin) {
 
 	if len(cfg.Topic) == 0 {
 		return
 	}
 
+	if cfg.MaxOutput <= 0 {
+		cfg.MaxOutput = 1024
+	}
+
+	// Drop any commands that are broken rather than finding out later
+	commands := make([]DeviceCommandConfig, 0, len(cfg.Commands))
+	for _, command := range cfg.Commands {
+		if err := checkCommand(&command, builtins); err != nil {
+			log.Errorf("command: %v", err)
+			continue
+		}
+		commands = append(commands, command)
+	}
+	cfg.Commands = commands
+
+	dm := &deviceMgmt{
+		bmux:      scope,
+		cfg:       cfg,
+		auth:      newDeviceAuth(cfg.Secrets, cfg.MaxSkew),
+		builtins:  builtins,
+		limits:    newCommandLimits(),
+		auditFile: newAuditFile(cfg.Audit),
+	}
+
 	//
-	// Process incoming commands
+	// Send logs to device/log, if asked
 	//
-	bmux.Subscribe(cfg.Topic+"cmd", 0, func(client mqtt.Client, msg mqtt.Message) {
-		payload := string(msg.Payload())
-		log.Infof("command: name=%s", payload)
-
-		// Walk all of the commands and see if the one passed in matches one in the table
-		for _, command := range cfg.Commands {
-			if strings.Compare(command.Name, payload) == 0 {
-				go func() {
-					execCommand := exec.Command("/bin/bash", "-c", command.CmdLine)
-					_, err := execCommand.CombinedOutput()
-					if err != nil {
-						log.Errorf("command: error=%v", err)
-					}
-				}()
-				break
-			}
+	if len(cfg.Log.Level) > 0 {
+		if err := logForward.attach(scope, cfg.Topic+"log", cfg.Log); err != nil {
+			log.Errorf("log: %v", err)
+		} else {
+			scope.OnStop(logForward.detach)
 		}
+	}
+
+	//
+	// Process incoming commands
+	//
+	scope.Subscribe(cfg.Topic+"cmd", 0, func(client mqtt.Client, msg mqtt.Message) {
+		go dm.handleCommand(msg.Payload())
 	})
 
 	//
-	// Sit and spin, posting local time and uptime every hour
+	// Health goes out on its own schedule
 	//
-	ticker := time.NewTicker(time.Hour)
-	uptime := 0
+	initDeviceHealth(scope, cfg.Topic, cfg.Health)
+	ha.announceDevice(cfg)
 
-	reportUptime(bmux, cfg.Topic, uptime)
+	//
+	// Spin in the background, posting local time and uptime every hour
+	//
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		uptime := 0
 
-	for {
-		select {
-		case <-ticker.C:
-			reportUptime(bmux, cfg.Topic, uptime)
-			uptime = uptime + 1
-		}
-	}
+		reportUptime(scope, cfg.Topic, uptime)
 
+		for {
+			select {
+			case <-ticker.C:
+				reportUptime(scope, cfg.Topic, uptime)
+				uptime = uptime + 1
+			case <-scope.Done():
+				return
+			}
+		}
+	}()
 }
 
 func reportUptime(bmux BrokerMux, baseTopic string, uptime int) {
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DeviceCommandParam describes a single argument a command accepts.  Types are enum (one of
+// values), int (min to max, inclusive) and string (which must match pattern, and can't start
+// with '-' so it can't pass for an option).  Params without a default are required.
+type DeviceCommandParam struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Values  []string `yaml:"values"`
+	Min     int      `yaml:"min"`
+	Max     int      `yaml:"max"`
+	Pattern string   `yaml:"pattern"`
+	Default string   `yaml:"default"`
+
+	// Compiled pattern, filled in by checkCommandParams
+	re *regexp.Regexp
+}
+
+var commandPlaceholder = regexp.MustCompile(`\{[A-Za-z0-9_]+\}`)
+
+//
+// checkCommand vets a command at startup so we don't find out the config is broken when
+// someone tries to use it.  It needs exactly one thing to run, and builtins must exist.
+//
+func checkCommand(command *DeviceCommandConfig, builtins map[string]deviceBuiltin) error {
+	runs := 0
+	for _, set := range []bool{len(command.CmdLine) > 0, len(command.Argv) > 0, len(command.Builtin) > 0} {
+		if set {
+			runs++
+		}
+	}
+	if runs != 1 {
+		return fmt.Errorf("%s: needs exactly one of cmdline, argv or builtin", command.Name)
+	}
+
+	if len(command.Builtin) > 0 {
+		if _, ok := builtins[command.Builtin]; !ok {
+			return fmt.Errorf("%s: unknown builtin %s", command.Name, command.Builtin)
+		}
+	}
+
+	return checkCommandParams(command)
+}
+
+//
+// checkCommandParams vets the params.  Params only work with argv and builtins since there is
+// no safe way to paste them into something bash is going to parse.  The compiled patterns go
+// in a fresh copy of params, since a copy of the command still shares them with the config,
+// and a config with patterns compiled in never matches a freshly loaded one on reload.
+//
+func checkCommandParams(command *DeviceCommandConfig) error {
+	if len(command.Params) > 0 && len(command.CmdLine) > 0 {
+		return fmt.Errorf("%s: params need argv or builtin, not cmdline", command.Name)
+	}
+
+	command.Params = append([]DeviceCommandParam(nil), command.Params...)
+
+	for i := range command.Params {
+		param := &command.Params[i]
+		switch param.Type {
+		case "enum":
+			if len(param.Values) == 0 {
+				return fmt.Errorf("%s: %s: enum with no values", command.Name, param.Name)
+			}
+		case "int":
+			if param.Max < param.Min {
+				return fmt.Errorf("%s: %s: max < min", command.Name, param.Name)
+			}
+		case "string":
+			if len(param.Pattern) == 0 {
+				return fmt.Errorf("%s: %s: string with no pattern", command.Name, param.Name)
+			}
+			re, err := regexp.Compile("^(?:" + param.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", command.Name, param.Name, err)
+			}
+			param.re = re
+		default:
+			return fmt.Errorf("%s: %s: unknown type %s", command.Name, param.Name, param.Type)
+		}
+	}
+
+	return nil
+}
+
+//
+// buildCommandArgv validates the incoming args and substitutes them into the argv from the
+// config.  Each {name} in an argv entry is replaced with the value, and since the result goes
+// straight to exec there is no quoting to get wrong.
+//
+func buildCommandArgv(command *DeviceCommandConfig, args map[string]interface{}) ([]string, error) {
+	values, err := checkCommandArgs(command, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// One pass per entry so a value that happens to look like {name} is left alone
+	argv := make([]string, 0, len(command.Argv))
+	for _, arg := range command.Argv {
+		argv = append(argv, commandPlaceholder.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			if value, ok := values[placeholder[1:len(placeholder)-1]]; ok {
+				return value
+			}
+			return placeholder
+		}))
+	}
+
+	return argv, nil
+}
+
+// checkCommandArgs validates the incoming args and fills in defaults
+func checkCommandArgs(command *DeviceCommandConfig, args map[string]interface{}) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for name := range args {
+		found := false
+		for _, param := range command.Params {
+			if param.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown arg %s", name)
+		}
+	}
+
+	for _, param := range command.Params {
+		raw, ok := args[param.Name]
+		if !ok {
+			if len(param.Default) == 0 {
+				return nil, fmt.Errorf("missing arg %s", param.Name)
+			}
+			raw = param.Default
+		}
+
+		value, err := checkCommandArg(param, raw)
+		if err != nil {
+			return nil, err
+		}
+		values[param.Name] = value
+	}
+
+	return values, nil
+}
+
+func checkCommandArg(param DeviceCommandParam, raw interface{}) (string, error) {
+	// JSON numbers show up as float64, but everything ends up as a string in argv
+	var value string
+	switch v := raw.(type) {
+	case string:
+		value = v
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		value = strconv.FormatBool(v)
+	default:
+		return "", fmt.Errorf("%s: bad type", param.Name)
+	}
+
+	switch param.Type {
+	case "enum":
+		for _, allowed := range param.Values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%s: %q is not one of %v", param.Name, value, param.Values)
+	case "int":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %q is not an int", param.Name, value)
+		}
+		if n < param.Min || n > param.Max {
+			return "", fmt.Errorf("%s: %d is not in %d-%d", param.Name, n, param.Min, param.Max)
+		}
+		return strconv.Itoa(n), nil
+	case "string":
+		if strings.HasPrefix(value, "-") {
+			return "", fmt.Errorf("%s: %q looks like an option", param.Name, value)
+		}
+		if param.re == nil || !param.re.MatchString(value) {
+			return "", fmt.Errorf("%s: %q does not match %s", param.Name, value, param.Pattern)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%s: unknown type %s", param.Name, param.Type)
+}
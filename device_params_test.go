@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testParamCommand(t *testing.T) *DeviceCommandConfig {
+	command := &DeviceCommandConfig{
+		Name: "ping",
+		Argv: []string{"/bin/ping", "-c", "{count}", "--", "{host}"},
+		Params: []DeviceCommandParam{
+			{Name: "count", Type: "int", Min: 1, Max: 10, Default: "3"},
+			{Name: "host", Type: "string", Pattern: "[A-Za-z0-9][A-Za-z0-9.-]*"},
+			{Name: "mode", Type: "enum", Values: []string{"fast", "slow"}, Default: "slow"},
+		},
+	}
+	if err := checkCommandParams(command); err != nil {
+		t.Fatalf("checkCommandParams: %v", err)
+	}
+	return command
+}
+
+func TestBuildCommandArgv(t *testing.T) {
+	command := testParamCommand(t)
+
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		want []string
+	}{
+		{"defaults", map[string]interface{}{"host": "example.com"}, []string{"/bin/ping", "-c", "3", "--", "example.com"}},
+		{"json number", map[string]interface{}{"host": "10.0.0.1", "count": float64(5)}, []string{"/bin/ping", "-c", "5", "--", "10.0.0.1"}},
+		{"enum", map[string]interface{}{"host": "a", "mode": "fast"}, []string{"/bin/ping", "-c", "3", "--", "a"}},
+	}
+
+	for _, test := range tests {
+		got, err := buildCommandArgv(command, test.args)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBuildCommandArgvRejects(t *testing.T) {
+	command := testParamCommand(t)
+
+	tests := []struct {
+		name string
+		args map[string]interface{}
+	}{
+		{"missing required", map[string]interface{}{}},
+		{"unknown arg", map[string]interface{}{"host": "a", "extra": "b"}},
+		{"option", map[string]interface{}{"host": "-f"}},
+		{"long option", map[string]interface{}{"host": "--flood"}},
+		{"shell", map[string]interface{}{"host": "a; reboot"}},
+		{"substitution", map[string]interface{}{"host": "$(reboot)"}},
+		{"space", map[string]interface{}{"host": "a b"}},
+		{"newline", map[string]interface{}{"host": "a\nb"}},
+		{"empty", map[string]interface{}{"host": ""}},
+		{"placeholder", map[string]interface{}{"host": "{count}"}},
+		{"int too big", map[string]interface{}{"host": "a", "count": float64(11)}},
+		{"int too small", map[string]interface{}{"host": "a", "count": "0"}},
+		{"int fraction", map[string]interface{}{"host": "a", "count": float64(2.5)}},
+		{"int text", map[string]interface{}{"host": "a", "count": "3 -f"}},
+		{"enum", map[string]interface{}{"host": "a", "mode": "fast; reboot"}},
+		{"object", map[string]interface{}{"host": map[string]interface{}{"a": "b"}}},
+		{"list", map[string]interface{}{"host": []interface{}{"a"}}},
+	}
+
+	for _, test := range tests {
+		if argv, err := buildCommandArgv(command, test.args); err == nil {
+			t.Errorf("%s: got %q, want an error", test.name, argv)
+		}
+	}
+}
+
+func TestCheckCommandParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		command DeviceCommandConfig
+		ok      bool
+	}{
+		{"argv", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "string", Pattern: "[a-z]+"}}}, true},
+		{"cmdline", DeviceCommandConfig{CmdLine: "x", Params: []DeviceCommandParam{{Name: "a", Type: "string", Pattern: "[a-z]+"}}}, false},
+		{"no pattern", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "string"}}}, false},
+		{"bad pattern", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "string", Pattern: "("}}}, false},
+		{"no values", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "enum"}}}, false},
+		{"max < min", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "int", Min: 2, Max: 1}}}, false},
+		{"unknown type", DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "file"}}}, false},
+	}
+
+	for _, test := range tests {
+		command := test.command
+		if err := checkCommandParams(&command); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestPatternIsAnchored(t *testing.T) {
+	// An unanchored pattern would match anything with a letter in it somewhere
+	command := &DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{{Name: "a", Type: "string", Pattern: "[a-z]+|[0-9]+"}}}
+	if err := checkCommandParams(command); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"abc;", "1 2", "a1"} {
+		if _, err := checkCommandArg(command.Params[0], value); err == nil {
+			t.Errorf("%q: want an error", value)
+		}
+	}
+}
+
+func TestStringCantBeOption(t *testing.T) {
+	// Even a pattern that allows a leading '-' doesn't let an option through
+	param := DeviceCommandParam{Name: "host", Type: "string", Pattern: "[A-Za-z0-9.-]+"}
+	command := &DeviceCommandConfig{Argv: []string{"x"}, Params: []DeviceCommandParam{param}}
+	if err := checkCommandParams(command); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkCommandArg(command.Params[0], "-f"); err == nil {
+		t.Error("-f: want an error")
+	}
+	if _, err := checkCommandArg(command.Params[0], "a-b"); err != nil {
+		t.Errorf("a-b: %v", err)
+	}
+}
+
+func TestCheckCommandLeavesConfig(t *testing.T) {
+	// Reload compares configs, so compiled patterns can't leak back into the one that was loaded
+	cfg := DeviceMgmtConfig{Commands: []DeviceCommandConfig{
+		{Name: "ping", Argv: []string{"x", "{host}"}, Params: []DeviceCommandParam{{Name: "host", Type: "string", Pattern: "[a-z]+"}}},
+	}}
+	for _, command := range cfg.Commands {
+		if err := checkCommand(&command, nil); err != nil {
+			t.Fatal(err)
+		}
+		if command.Params[0].re == nil {
+			t.Error("checked copy has no pattern")
+		}
+	}
+	if cfg.Commands[0].Params[0].re != nil {
+		t.Error("config has a compiled pattern")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MatrixSourcesConfig is everything that can feed an LED matrix
+type MatrixSourcesConfig struct {
+	Weather      WeatherConfig        `yaml:"weather"`
+	TempSensors  []TempSensorConfig   `yaml:"sensors"`
+	RemoteImages RemoteImageConfig    `yaml:"remote"`
+	LocalImages  LocalImagesConfig    `yaml:"local"`
+	Strings      StringsConfig        `yaml:"strings"`
+	Mirror       []MirrorConfig       `yaml:"mirror"`
+	Control      DisplayControlConfig `yaml:"control"`
+	Clock        ClockConfig          `yaml:"clock"`
+}
+
+// DisplayConfig describes a single LED matrix.  Every matrix topic in the sources is relative
+// to the prefix, so "weather" on a display with a prefix of "local:matrix/2/" ends up on
+// local:matrix/2/weather.  Images are resized to fit if width and height are set.
+type DisplayConfig struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+
+	// Payload format for the topics on this display.  Anything not listed in outputs
+	// gets the default format, which is legacy if not set.
+	Format  string               `yaml:"format"`
+	Outputs []MatrixOutputConfig `yaml:"outputs"`
+
+	MatrixSourcesConfig `yaml:",inline"`
+}
+
+// SharedSourcesConfig is a set of sources that run once and fan out to the named displays, or
+// all of them if none are named.  Each display still formats things its own way.
+type SharedSourcesConfig struct {
+	Displays            []string `yaml:"displays"`
+	MatrixSourcesConfig `yaml:",inline"`
+}
+
+// MatrixConfig is the matrix section of the config file.  The top level is a display all by
+// itself for the old single display configs, where the prefix is empty and all topics are
+// absolute.
+type MatrixConfig struct {
+	DisplayConfig `yaml:",inline"`
+
+	Displays []DisplayConfig       `yaml:"displays"`
+	Shared   []SharedSourcesConfig `yaml:"shared"`
+}
+
+//
+// Init.  Every kind of source on every display is its own module, so changing a joke only
+// restarts the strings on that one display.  Each gets its own matrix mux for the display (or
+// displays) it feeds, which is cheap since they are just config.
+//
+func matrixModules(cfg MatrixConfig) []appModule {
+	// The top level display, which is what older configs use
+	name := cfg.Name
+	if len(name) == 0 {
+		name = "default"
+	}
+	top := displayOutput(cfg.DisplayConfig)
+	modules := matrixSourceModules("matrix/"+name, []DisplayConfig{top}, cfg.MatrixSourcesConfig)
+
+	// The top level only counts as a target for shared sources if it has a prefix, otherwise
+	// shared sources would publish to relative topics on no broker at all
+	displays := make(map[string]DisplayConfig)
+	order := make([]string, 0, len(cfg.Displays)+1)
+	if len(cfg.Prefix) > 0 {
+		displays[name] = top
+		order = append(order, name)
+	}
+
+	// Displays without a prefix or with a duplicate name don't make it past validateConfig
+	for _, display := range cfg.Displays {
+		if _, ok := displays[display.Name]; ok || len(display.Prefix) == 0 {
+			continue
+		}
+		displays[display.Name] = displayOutput(display)
+		order = append(order, display.Name)
+
+		modules = append(modules, matrixSourceModules("matrix/"+display.Name, []DisplayConfig{displays[display.Name]}, display.MatrixSourcesConfig)...)
+	}
+
+	// Shared sources get a fanout to the displays they care about
+	for i, shared := range cfg.Shared {
+		names := shared.Displays
+		if len(names) == 0 {
+			names = order
+		}
+
+		targets := make([]DisplayConfig, 0, len(names))
+		for _, name := range names {
+			if display, ok := displays[name]; ok {
+				targets = append(targets, display)
+			}
+		}
+
+		modules = append(modules, matrixSourceModules("matrix/shared/"+strconv.Itoa(i), targets, shared.MatrixSourcesConfig)...)
+	}
+
+	return modules
+}
+
+// displayOutput is the part of a display that says how to publish to it, without the sources
+func displayOutput(display DisplayConfig) DisplayConfig {
+	display.MatrixSourcesConfig = MatrixSourcesConfig{}
+	return display
+}
+
+// matrixSourceModules makes a module for each kind of source that is configured.  A module's
+// config includes the displays it publishes to, so changing a display restarts its sources.
+func matrixSourceModules(prefix string, targets []DisplayConfig, cfg MatrixSourcesConfig) []appModule {
+	sources := []struct {
+		name  string
+		cfg   interface{}
+		start func(scope *moduleScope, mmux MatrixMux)
+	}{
+		{"remote", cfg.RemoteImages, func(scope *moduleScope, mmux MatrixMux) { initRemoteImages(scope, mmux, cfg.RemoteImages) }},
+		{"sensors", cfg.TempSensors, func(scope *moduleScope, mmux MatrixMux) { initTempSensors(scope, mmux, cfg.TempSensors) }},
+		{"weather", cfg.Weather, func(scope *moduleScope, mmux MatrixMux) { initWeather(scope, mmux, cfg.Weather) }},
+		{"local", cfg.LocalImages, func(scope *moduleScope, mmux MatrixMux) { initLocalImages(scope, mmux, cfg.LocalImages) }},
+		{"strings", cfg.Strings, func(scope *moduleScope, mmux MatrixMux) { initStrings(scope, mmux, cfg.Strings) }},
+		{"mirror", cfg.Mirror, func(scope *moduleScope, mmux MatrixMux) { initMirror(scope, mmux, cfg.Mirror) }},
+		{"control", cfg.Control, func(scope *moduleScope, mmux MatrixMux) { initDisplayControl(scope, mmux, cfg.Control) }},
+		{"clock", cfg.Clock, func(scope *moduleScope, mmux MatrixMux) { initClock(scope, mmux, cfg.Clock) }},
+	}
+
+	modules := make([]appModule, 0, len(sources))
+	for _, source := range sources {
+		if reflect.ValueOf(source.cfg).IsZero() {
+			continue
+		}
+
+		start := source.start
+		modules = append(modules, appModule{
+			name: prefix + "/" + source.name,
+			cfg:  []interface{}{targets, source.cfg},
+			start: func(a *app, scope *moduleScope) {
+				muxes := make(matrixFanout, 0, len(targets))
+				for _, target := range targets {
+					muxes = append(muxes, newMatrixMux(scope, target))
+				}
+				if len(muxes) == 1 {
+					start(scope, muxes[0])
+				} else {
+					start(scope, muxes)
+				}
+			},
+		})
+	}
+	return modules
+}
+
+//
+// matrixFanout publishes the same thing to a bunch of displays.  Each one formats the data
+// on its own, so one weather fetch can go out as legacy text to one display and JSON to another.
+//
+type matrixFanout []MatrixMux
+
+func (f matrixFanout) PublishText(topic string, lines []string) mqtt.Token {
+	tokens := make([]mqtt.Token, 0, len(f))
+	for _, mmux := range f {
+		tokens = append(tokens, mmux.PublishText(topic, lines))
+	}
+	return &multiToken{tokens: tokens}
+}
+
+func (f matrixFanout) PublishImage(topic string, img *image.NRGBA) mqtt.Token {
+	tokens := make([]mqtt.Token, 0, len(f))
+	for _, mmux := range f {
+		tokens = append(tokens, mmux.PublishImage(topic, img))
+	}
+	return &multiToken{tokens: tokens}
+}
+
+func (f matrixFanout) PublishRaw(topic string, payload interface{}) mqtt.Token {
+	tokens := make([]mqtt.Token, 0, len(f))
+	for _, mmux := range f {
+		tokens = append(tokens, mmux.PublishRaw(topic, payload))
+	}
+	return &multiToken{tokens: tokens}
+}
+
+func (f matrixFanout) PublishControl(topic string, power bool, brightness int) mqtt.Token {
+	tokens := make([]mqtt.Token, 0, len(f))
+	for _, mmux := range f {
+		tokens = append(tokens, mmux.PublishControl(topic, power, brightness))
+	}
+	return &multiToken{tokens: tokens}
+}
+
+//
+// multiToken is done when all of the tokens it wraps are done, and returns the first error
+//
+type multiToken struct {
+	tokens []mqtt.Token
+}
+
+func (m *multiToken) Wait() bool {
+	for _, t := range m.tokens {
+		t.Wait()
+	}
+	return true
+}
+
+func (m *multiToken) WaitTimeout(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for _, t := range m.tokens {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if !t.WaitTimeout(remaining) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiToken) Error() error {
+	for _, t := range m.tokens {
+		if err := t.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for _, t := range m.tokens {
+			<-t.Done()
+		}
+		close(done)
+	}()
+	return done
+}
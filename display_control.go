@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// DisplayControlConfig drives the brightness and power of a display.  Brightness comes from
+// the ambient light topic if we have a recent reading, and from the time of day curve if not.
+// Curve points are "HH:MM", "sunrise" or "sunset", with an optional offset in minutes such
+// as "sunset-30".  Brightness runs from 0-100, and anything at or below offBelow turns the
+// display off.
+type DisplayControlConfig struct {
+	Topic string       `yaml:"topic"`
+	Jobs  JobRunnerCfg `yaml:"jobs"`
+	Curve []struct {
+		Time       string `yaml:"time"`
+		Brightness int    `yaml:"brightness"`
+	} `yaml:"curve"`
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	OffBelow  int     `yaml:"offBelow"`
+
+	Ambient struct {
+		Sub           string  `yaml:"sub"`
+		Field         string  `yaml:"field"`
+		Min           float64 `yaml:"min"`
+		Max           float64 `yaml:"max"`
+		MinBrightness int     `yaml:"minBrightness"`
+		MaxBrightness int     `yaml:"maxBrightness"`
+		MaxAge        int     `yaml:"maxAge"`
+	} `yaml:"ambient"`
+}
+
+type displayControl struct {
+	cfg    DisplayControlConfig
+	mmux   MatrixMux
+	health *healthEntry
+
+	// Ambient readings come in on the MQTT goroutine, while the job runs on its own
+	lock        sync.Mutex
+	ambient     float64
+	ambientTime time.Time
+}
+
+//
+// Init
+//
+func initDisplayControl(scope *moduleScope, mmux MatrixMux, cfg DisplayControlConfig) {
+	if len(cfg.Topic) == 0 {
+		return
+	}
+
+	if len(cfg.Curve) == 0 && len(cfg.Ambient.Sub) == 0 {
+		log.Errorf("control: %s: no curve or ambient topic", cfg.Topic)
+		return
+	}
+
+	if cfg.Ambient.MaxAge <= 0 {
+		cfg.Ambient.MaxAge = 15
+	}
+	if cfg.Ambient.MaxBrightness <= 0 {
+		cfg.Ambient.MaxBrightness = 100
+	}
+
+	ctrl := &displayControl{cfg: cfg, mmux: mmux}
+
+	if len(cfg.Ambient.Sub) > 0 {
+		ctrl.health = scope.Health("control-ambient", time.Duration(cfg.Ambient.MaxAge)*time.Minute)
+		t := scope.Subscribe(cfg.Ambient.Sub, 0, func(client mqtt.Client, msg mqtt.Message) {
+			ctrl.processAmbient(msg.Payload())
+		})
+		t.Wait()
+		if t.Error() != nil {
+			log.Errorf("control: %s: %v", cfg.Ambient.Sub, t.Error())
+		}
+	}
+
+	scope.NewJobRunner("control-"+cfg.Topic, cfg.Jobs, func() {
+		ctrl.publish(time.Now())
+	}).Run()
+}
+
+//
+// Ambient light is either a raw number or a JSON object with the number in the given field
+//
+func (ctrl *displayControl) processAmbient(payload []byte) {
+	var level float64
+	var err error
+
+	if len(ctrl.cfg.Ambient.Field) > 0 {
+		var fields map[string]interface{}
+		if err = json.Unmarshal(payload, &fields); err == nil {
+			value, ok := fields[ctrl.cfg.Ambient.Field].(float64)
+			if !ok {
+				err = fmt.Errorf("no numeric %s", ctrl.cfg.Ambient.Field)
+			}
+			level = value
+		}
+	} else {
+		level, err = strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+
+	if err != nil {
+		log.Errorf("control: ambient: %v", err)
+		ctrl.health.Error(err)
+		return
+	}
+	ctrl.health.Success()
+
+	ctrl.lock.Lock()
+	ctrl.ambient = level
+	ctrl.ambientTime = time.Now()
+	ctrl.lock.Unlock()
+}
+
+func (ctrl *displayControl) publish(now time.Time) {
+	brightness, ok := ctrl.ambientBrightness(now)
+	if !ok {
+		brightness, ok = ctrl.curveBrightness(now)
+	}
+	if !ok {
+		log.Debugf("control: %s: nothing to do", ctrl.cfg.Topic)
+		return
+	}
+
+	power := brightness > ctrl.cfg.OffBelow && brightness > 0
+	log.Infof("control: %s: power=%v brightness=%d", ctrl.cfg.Topic, power, brightness)
+	ctrl.mmux.PublishControl(ctrl.cfg.Topic, power, brightness)
+}
+
+func (ctrl *displayControl) ambientBrightness(now time.Time) (int, bool) {
+	ctrl.lock.Lock()
+	level := ctrl.ambient
+	when := ctrl.ambientTime
+	ctrl.lock.Unlock()
+
+	if when.IsZero() || now.Sub(when) > time.Duration(ctrl.cfg.Ambient.MaxAge)*time.Minute {
+		return 0, false
+	}
+
+	amb := ctrl.cfg.Ambient
+	if amb.Max <= amb.Min {
+		return amb.MaxBrightness, true
+	}
+
+	fraction := (level - amb.Min) / (amb.Max - amb.Min)
+	fraction = math.Max(0, math.Min(1, fraction))
+	return amb.MinBrightness + int(math.Round(fraction*float64(amb.MaxBrightness-amb.MinBrightness))), true
+}
+
+//
+// The curve is resolved to minutes past midnight every time since sunrise and sunset move
+// around, and the brightness is interpolated between the points on either side of now.
+//
+type curvePoint struct {
+	minute     int
+	brightness int
+}
+
+func (ctrl *displayControl) curveBrightness(now time.Time) (int, bool) {
+	points := make([]curvePoint, 0, len(ctrl.cfg.Curve))
+	for _, p := range ctrl.cfg.Curve {
+		minute, err := ctrl.resolveCurveTime(p.Time, now)
+		if err != nil {
+			log.Errorf("control: curve: %s: %v", p.Time, err)
+			continue
+		}
+		points = append(points, curvePoint{minute: minute, brightness: p.Brightness})
+	}
+
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].minute < points[j].minute })
+
+	// Find the points on either side, wrapping around midnight if needed
+	current := now.Hour()*60 + now.Minute()
+	prev := points[len(points)-1]
+	prev.minute = prev.minute - 24*60
+	next := points[0]
+	next.minute = next.minute + 24*60
+	for _, p := range points {
+		if p.minute <= current {
+			prev = p
+		}
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].minute > current {
+			next = points[i]
+		}
+	}
+
+	if next.minute == prev.minute {
+		return prev.brightness, true
+	}
+
+	fraction := float64(current-prev.minute) / float64(next.minute-prev.minute)
+	return prev.brightness + int(math.Round(fraction*float64(next.brightness-prev.brightness))), true
+}
+
+func (ctrl *displayControl) resolveCurveTime(text string, now time.Time) (int, error) {
+	text = strings.TrimSpace(text)
+
+	for _, event := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(text, event) {
+			continue
+		}
+
+		offset := 0
+		if rest := text[len(event):]; len(rest) > 0 {
+			var err error
+			if offset, err = strconv.Atoi(rest); err != nil {
+				return 0, err
+			}
+		}
+
+		sunrise, sunset, ok := sunTimes(now, ctrl.cfg.Latitude, ctrl.cfg.Longitude)
+		if !ok {
+			return 0, fmt.Errorf("no %s today", event)
+		}
+		t := sunrise
+		if event == "sunset" {
+			t = sunset
+		}
+		t = t.In(now.Location()).Add(time.Duration(offset) * time.Minute)
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+//
+// sunTimes is the usual NOAA sunrise/sunset approximation, which is good to a minute or two.
+// That is plenty for dimming some LEDs.  ok is false if the sun doesn't rise or set today.
+//
+func sunTimes(day time.Time, latitude float64, longitude float64) (time.Time, time.Time, bool) {
+	const zenith = 90.833
+
+	rad := math.Pi / 180
+	dayOfYear := float64(day.YearDay())
+	lngHour := longitude / 15
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	calc := func(rising bool) (time.Time, bool) {
+		t := dayOfYear + (18-lngHour)/24
+		if rising {
+			t = dayOfYear + (6-lngHour)/24
+		}
+
+		m := 0.9856*t - 3.289
+		l := normalizeDegrees(m + 1.916*math.Sin(m*rad) + 0.020*math.Sin(2*m*rad) + 282.634)
+
+		ra := normalizeDegrees(math.Atan(0.91764*math.Tan(l*rad)) / rad)
+		ra = (ra + math.Floor(l/90)*90 - math.Floor(ra/90)*90) / 15
+
+		sinDec := 0.39782 * math.Sin(l*rad)
+		cosDec := math.Cos(math.Asin(sinDec))
+		cosH := (math.Cos(zenith*rad) - sinDec*math.Sin(latitude*rad)) / (cosDec * math.Cos(latitude*rad))
+		if cosH > 1 || cosH < -1 {
+			return time.Time{}, false
+		}
+
+		h := math.Acos(cosH) / rad
+		if rising {
+			h = 360 - h
+		}
+
+		ut := math.Mod(h/15+ra-0.06571*t-6.622-lngHour+48, 24)
+		return midnight.Add(time.Duration(ut * float64(time.Hour))), true
+	}
+
+	sunrise, ok1 := calc(true)
+	sunset, ok2 := calc(false)
+	return sunrise, sunset, ok1 && ok2
+}
+
+func normalizeDegrees(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d = d + 360
+	}
+	return d
+}
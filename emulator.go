@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/font/basicfont"
+)
+
+// EmulatorConfig lets me pretend to be the LED matrix on a laptop.  It subscribes to the
+// given topics and dumps whatever shows up to a truecolor terminal and/or PNG files.
+type EmulatorConfig struct {
+	Topics    []string `yaml:"topics"`
+	Width     int      `yaml:"width"`
+	Height    int      `yaml:"height"`
+	Terminal  bool     `yaml:"terminal"`
+	Snapshots string   `yaml:"snapshots"`
+	Scale     int      `yaml:"scale"`
+}
+
+type emulator struct {
+	cfg EmulatorConfig
+
+	// Subscribe callbacks come in on random goroutines, and I don't want frames interleaved
+	lock sync.Mutex
+}
+
+//
+// Init
+//
+func initEmulator(bmux BrokerMux, cfg EmulatorConfig) {
+	if len(cfg.Topics) == 0 {
+		return
+	}
+
+	if cfg.Width <= 0 {
+		cfg.Width = 64
+	}
+	if cfg.Height <= 0 {
+		cfg.Height = 32
+	}
+	if cfg.Scale <= 0 {
+		cfg.Scale = 8
+	}
+
+	if len(cfg.Snapshots) > 0 {
+		if err := os.MkdirAll(cfg.Snapshots, 0755); err != nil {
+			log.Errorf("emulator: snapshots: %v", err)
+			cfg.Snapshots = ""
+		}
+	}
+
+	emu := &emulator{cfg: cfg}
+
+	for _, topic := range cfg.Topics {
+		log.Infof("emulator: %s", topic)
+		t := bmux.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+			emu.render(msg.Topic(), msg.Payload())
+		})
+		t.Wait()
+		if t.Error() != nil {
+			log.Errorf("emulator: %s: %v", topic, t.Error())
+		}
+	}
+}
+
+//
+// Figure out what we were sent and turn it into a frame
+//
+func (emu *emulator) render(topic string, payload []byte) {
+	var frame *image.NRGBA
+
+	var envelope matrixEnvelope
+	if len(payload) > 0 && payload[0] == '{' && json.Unmarshal(payload, &envelope) == nil && envelope.Version > 0 {
+		switch envelope.Type {
+		case "text":
+			frame = emu.textFrame(envelope.Lines, envelope.Colors)
+		case "image":
+			if envelope.Image != nil {
+				frame = emu.rawFrame(envelope.Image.Data, envelope.Image.Width, envelope.Image.Height)
+			}
+		case "control":
+			log.Infof("emulator: %s: power=%s brightness=%d", topic, envelope.Power, envelope.Brightness)
+			return
+		default:
+			log.Infof("emulator: %s: %s: %s", topic, envelope.Type, strings.Join(envelope.Lines, " | "))
+			return
+		}
+	} else if len(payload) == emu.cfg.Width*emu.cfg.Height*3 {
+		frame = emu.rawFrame(payload, emu.cfg.Width, emu.cfg.Height)
+	} else {
+		frame = emu.textFrame(strings.Split(latin1ToUTF8(string(payload)), ":"), nil)
+	}
+
+	if frame == nil {
+		log.Errorf("emulator: %s: unable to render %d bytes", topic, len(payload))
+		return
+	}
+
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+
+	if emu.cfg.Terminal {
+		fmt.Printf("%s %s\n%s", time.Now().Format("15:04:05"), topic, frameToANSI(frame))
+	}
+
+	if len(emu.cfg.Snapshots) > 0 {
+		emu.snapshot(topic, frame)
+	}
+}
+
+// rawFrame turns the output of ImageToMatrixBytes back into an image
+func (emu *emulator) rawFrame(raw []byte, width int, height int) *image.NRGBA {
+	if width <= 0 || height <= 0 || len(raw) < width*height*3 {
+		return nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	index := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: raw[index+0], G: raw[index+1], B: raw[index+2], A: 0xff})
+			index = index + 3
+		}
+	}
+	return img
+}
+
+//
+// textFrame draws the lines with the only font I have handy.  It is not the font the matrix
+// uses, but it is close enough to see if things fit.  Lines that are wider than the display
+// make the frame wider since the real thing scrolls them.
+//
+func (emu *emulator) textFrame(lines []string, colors []string) *image.NRGBA {
+	face := basicfont.Face7x13
+
+	width := emu.cfg.Width
+	height := emu.cfg.Height
+	for _, line := range lines {
+		if w := len([]rune(line)) * face.Advance; w > width {
+			width = w
+		}
+	}
+	if h := len(lines) * face.Height; h > height {
+		height = h
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	for i, line := range lines {
+		c := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+		if i < len(colors) {
+			if parsed, ok := parseHexColor(colors[i]); ok {
+				c = parsed
+			}
+		}
+
+		// No degree sign in basicfont, so use something the same width
+		drawText(img, 0, i*face.Height, c, strings.ReplaceAll(line, "°", "o"))
+	}
+
+	return img
+}
+
+func (emu *emulator) snapshot(topic string, frame *image.NRGBA) {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(topic)
+	path := filepath.Join(emu.cfg.Snapshots, fmt.Sprintf("%s-%s.png", name, time.Now().Format("20060102-150405")))
+
+	bounds := frame.Bounds()
+	scaled := imaging.Resize(frame, bounds.Dx()*emu.cfg.Scale, bounds.Dy()*emu.cfg.Scale, imaging.NearestNeighbor)
+	if err := imaging.Save(scaled, path); err != nil {
+		log.Errorf("emulator: snapshot: %v", err)
+		return
+	}
+	log.Debugf("emulator: snapshot: %s", path)
+}
+
+//
+// frameToANSI uses the upper half block so each character cell is two pixels tall, with the
+// foreground as the top pixel and the background as the bottom one.
+//
+func frameToANSI(img *image.NRGBA) string {
+	var b strings.Builder
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			top := img.NRGBAAt(x, y)
+			bottom := color.NRGBA{}
+			if y+1 < bounds.Max.Y {
+				bottom = img.NRGBAAt(x, y+1)
+			}
+			fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
+
+// parseHexColor handles #RRGGBB, which is all the envelope colors are expected to be
+func parseHexColor(s string) (color.NRGBA, bool) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.NRGBA{}, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{R: byte(v >> 16), G: byte(v >> 8), B: byte(v), A: 0xff}, true
+}
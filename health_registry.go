@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// The health registry is where everything reports in, so a weather key that went bad or an
+// rtl_433 that quietly died shows up somewhere other than the logs.  Each entry is one thing
+// that can fail (a weather location, an rtl_433, a sensor group), and keeps a heartbeat and
+// the last success and error.  Entries with a max age go stale if they don't hear anything
+// for that long.
+//
+type healthRegistry struct {
+	lock    sync.Mutex
+	entries map[string]*healthEntry
+
+	// Poked whenever an entry changes status, so the device module can publish right away
+	changed chan struct{}
+}
+
+type healthEntry struct {
+	reg    *healthRegistry
+	name   string
+	maxAge time.Duration
+	since  time.Time
+
+	lastBeat    time.Time
+	lastSuccess time.Time
+	lastError   time.Time
+	err         string
+	errors      int
+	status      string
+}
+
+const (
+	healthStarting = "starting"
+	healthOK       = "ok"
+	healthError    = "error"
+	healthStale    = "stale"
+)
+
+// What goes out on device/modules
+type healthDocument struct {
+	Time    string                  `json:"time"`
+	OK      bool                    `json:"ok"`
+	Failing []string                `json:"failing"`
+	Modules map[string]healthStatus `json:"modules"`
+}
+
+type healthStatus struct {
+	Status      string `json:"status"`
+	LastBeat    string `json:"lastBeat,omitempty"`
+	LastSuccess string `json:"lastSuccess,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Errors      int    `json:"errors"`
+}
+
+var moduleHealth = &healthRegistry{
+	entries: make(map[string]*healthEntry),
+	changed: make(chan struct{}, 1),
+}
+
+// register adds an entry.  The same thing configured twice (say, the same zip code on two
+// displays) gets a number tacked on.
+func (reg *healthRegistry) register(name string, maxAge time.Duration) *healthEntry {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	unique := name
+	for i := 2; reg.entries[unique] != nil; i++ {
+		unique = name + "#" + strconv.Itoa(i)
+	}
+
+	h := &healthEntry{reg: reg, name: unique, maxAge: maxAge, since: time.Now(), status: healthStarting}
+	reg.entries[unique] = h
+	return h
+}
+
+func (reg *healthRegistry) unregister(h *healthEntry) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if reg.entries[h.name] == h {
+		delete(reg.entries, h.name)
+	}
+}
+
+// Beat says we're still alive without saying whether anything worked
+func (h *healthEntry) Beat() {
+	h.reg.lock.Lock()
+	defer h.reg.lock.Unlock()
+
+	h.lastBeat = time.Now()
+	h.reg.notify(h.update(h.lastBeat))
+}
+
+func (h *healthEntry) Success() {
+	h.reg.lock.Lock()
+	defer h.reg.lock.Unlock()
+
+	h.lastBeat = time.Now()
+	h.lastSuccess = h.lastBeat
+	h.reg.notify(h.update(h.lastBeat))
+}
+
+func (h *healthEntry) Error(err error) {
+	h.reg.lock.Lock()
+	defer h.reg.lock.Unlock()
+
+	h.lastBeat = time.Now()
+	h.lastError = h.lastBeat
+	h.err = err.Error()
+	h.errors++
+	h.reg.notify(h.update(h.lastBeat))
+}
+
+// Result is Success or Error depending on err
+func (h *healthEntry) Result(err error) {
+	if err != nil {
+		h.Error(err)
+	} else {
+		h.Success()
+	}
+}
+
+// update works out the status and returns true if it changed.  Call with the lock held.
+func (h *healthEntry) update(now time.Time) bool {
+	// Something that never checks in at all goes stale too
+	heard := h.lastBeat
+	if heard.IsZero() {
+		heard = h.since
+	}
+
+	status := healthStarting
+	switch {
+	case h.maxAge > 0 && now.Sub(heard) > h.maxAge:
+		status = healthStale
+	case !h.lastError.IsZero() && !h.lastError.Before(h.lastSuccess):
+		status = healthError
+	case !h.lastBeat.IsZero():
+		status = healthOK
+	}
+
+	if status == h.status {
+		return false
+	}
+	h.status = status
+	return true
+}
+
+func (reg *healthRegistry) notify(changed bool) {
+	if !changed {
+		return
+	}
+	select {
+	case reg.changed <- struct{}{}:
+	default:
+	}
+}
+
+// document is the current status of everything, checking for anything that went stale
+func (reg *healthRegistry) document() *healthDocument {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	now := time.Now()
+	doc := &healthDocument{
+		Time:    now.Format(time.RFC3339),
+		OK:      true,
+		Failing: []string{},
+		Modules: make(map[string]healthStatus, len(reg.entries)),
+	}
+
+	// Nobody needs poking about things going stale, since this is what gets published
+	for name, h := range reg.entries {
+		h.update(now)
+
+		doc.Modules[name] = healthStatus{
+			Status:      h.status,
+			LastBeat:    formatHealthTime(h.lastBeat),
+			LastSuccess: formatHealthTime(h.lastSuccess),
+			LastError:   formatHealthTime(h.lastError),
+			Error:       h.err,
+			Errors:      h.errors,
+		}
+
+		if h.status == healthError || h.status == healthStale {
+			doc.OK = false
+			doc.Failing = append(doc.Failing, name)
+		}
+	}
+	sort.Strings(doc.Failing)
+
+	return doc
+}
+
+func (reg *healthRegistry) marshal() ([]byte, error) {
+	return json.Marshal(reg.document())
+}
+
+func formatHealthTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
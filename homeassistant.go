@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HomeAssistantConfig turns on MQTT discovery so HA picks up the SDR sensors and the device
+// health and commands on its own.  Prefix is the discovery prefix as a mux topic, and it
+// needs to be on the same broker as the topics it points at.  SDR sensors that haven't been
+// heard from in expire minutes are removed from HA.
+type HomeAssistantConfig struct {
+	Prefix string `yaml:"prefix"`
+	Node   string `yaml:"node"`
+	Expire int    `yaml:"expire"`
+}
+
+// How each field we publish shows up in HA.  Anything not in here still works, it just
+// doesn't get a unit or class.
+type haFieldInfo struct {
+	unit        string
+	deviceClass string
+}
+
+var haFields = map[string]haFieldInfo{
+	"temperature": {"°C", "temperature"},
+	"humidity":    {"%", "humidity"},
+	"windSpeed":   {"km/h", "wind_speed"},
+	"windDir":     {"°", ""},
+	"rain":        {"mm", "precipitation"},
+	"pressure":    {"hPa", "pressure"},
+	"moisture":    {"%", "moisture"},
+	"power":       {"W", "power"},
+	"energy":      {"kWh", "energy"},
+}
+
+// The bits of the discovery payload we use
+type haConfigPayload struct {
+	Name           string    `json:"name"`
+	UniqueID       string    `json:"unique_id"`
+	StateTopic     string    `json:"state_topic,omitempty"`
+	ValueTemplate  string    `json:"value_template,omitempty"`
+	Unit           string    `json:"unit_of_measurement,omitempty"`
+	DeviceClass    string    `json:"device_class,omitempty"`
+	StateClass     string    `json:"state_class,omitempty"`
+	CommandTopic   string    `json:"command_topic,omitempty"`
+	PayloadPress   string    `json:"payload_press,omitempty"`
+	EntityCategory string    `json:"entity_category,omitempty"`
+	ExpireAfter    int       `json:"expire_after,omitempty"`
+	Device         *haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+	SWVersion   string   `json:"sw_version,omitempty"`
+	ViaDevice   string   `json:"via_device,omitempty"`
+}
+
+type haSensor struct {
+	lastSeen time.Time
+	configs  []string
+}
+
+type haDiscovery struct {
+	cfg    HomeAssistantConfig
+	scope  *moduleScope
+	broker string
+
+	// The SDR and device code call in from their own goroutines
+	lock    sync.Mutex
+	sensors map[string]*haSensor
+}
+
+//
+// Init.  Returns nil if discovery is turned off, and all of the methods are fine with that.
+//
+func newHADiscovery(scope *moduleScope, cfg HomeAssistantConfig) *haDiscovery {
+	if len(cfg.Prefix) == 0 {
+		return nil
+	}
+
+	if len(cfg.Node) == 0 {
+		cfg.Node = "matrix"
+	}
+	if cfg.Expire <= 0 {
+		cfg.Expire = 60
+	}
+
+	broker, _ := splitMuxTopic(cfg.Prefix)
+	ha := &haDiscovery{
+		cfg:     cfg,
+		scope:   scope,
+		broker:  broker,
+		sensors: make(map[string]*haSensor),
+	}
+
+	go ha.expireLoop()
+
+	return ha
+}
+
+func (ha *haDiscovery) configTopic(component string, objectID string) string {
+	return ha.cfg.Prefix + component + "/" + ha.cfg.Node + "/" + objectID + "/config"
+}
+
+// stateTopic strips the broker off of a mux topic, since HA only sees its own broker
+func (ha *haDiscovery) stateTopic(muxTopic string) (string, bool) {
+	broker, topic := splitMuxTopic(muxTopic)
+	if broker != ha.broker {
+		log.Errorf("homeassistant: %s is not on broker %s", muxTopic, ha.broker)
+		return "", false
+	}
+	return topic, true
+}
+
+func (ha *haDiscovery) publishConfig(topic string, payload *haConfigPayload) {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("homeassistant: %v", err)
+		return
+	}
+	log.Debugf("homeassistant: config: %s", topic)
+	ha.scope.Publish(topic, 1, true, out)
+}
+
+func (ha *haDiscovery) gatewayDevice() string {
+	return "matrix_" + ha.cfg.Node
+}
+
+//
+// SDR sensors.  Configs go out the first time we see each field, and get removed if the
+// sensor goes quiet for too long.
+//
+func (ha *haDiscovery) sensorSeen(model string, id string, muxTopic string, fields []string) {
+	if ha == nil {
+		return
+	}
+
+	stateTopic, ok := ha.stateTopic(muxTopic)
+	if !ok {
+		return
+	}
+
+	key := haObjectID(model + "_" + id)
+
+	ha.lock.Lock()
+	defer ha.lock.Unlock()
+
+	sensor, ok := ha.sensors[key]
+	if !ok {
+		sensor = &haSensor{}
+		ha.sensors[key] = sensor
+	}
+	sensor.lastSeen = time.Now()
+
+	device := &haDevice{
+		Identifiers: []string{"matrix_sdr_" + key},
+		Name:        model + " " + id,
+		Model:       model,
+		ViaDevice:   ha.gatewayDevice(),
+	}
+
+	for _, field := range fields {
+		topic := ha.configTopic("sensor", "sdr_"+key+"_"+haObjectID(field))
+
+		announced := false
+		for _, t := range sensor.configs {
+			if t == topic {
+				announced = true
+				break
+			}
+		}
+		if announced {
+			continue
+		}
+
+		info := haFields[field]
+		ha.publishConfig(topic, &haConfigPayload{
+			Name:          model + " " + id + " " + field,
+			UniqueID:      "matrix_sdr_" + key + "_" + haObjectID(field),
+			StateTopic:    stateTopic,
+			ValueTemplate: "{{ value_json." + field + " }}",
+			Unit:          info.unit,
+			DeviceClass:   info.deviceClass,
+			StateClass:    "measurement",
+			ExpireAfter:   ha.cfg.Expire * 60,
+			Device:        device,
+		})
+		sensor.configs = append(sensor.configs, topic)
+	}
+}
+
+func (ha *haDiscovery) expireLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ha.expire(time.Now())
+		case <-ha.scope.Done():
+			return
+		}
+	}
+}
+
+func (ha *haDiscovery) expire(now time.Time) {
+	ha.lock.Lock()
+	defer ha.lock.Unlock()
+
+	for key, sensor := range ha.sensors {
+		if now.Sub(sensor.lastSeen) < time.Duration(ha.cfg.Expire)*time.Minute {
+			continue
+		}
+
+		// An empty retained config is how HA is told to forget about something
+		log.Infof("homeassistant: removing %s", key)
+		for _, topic := range sensor.configs {
+			ha.scope.Publish(topic, 1, true, []byte{})
+		}
+		delete(ha.sensors, key)
+	}
+}
+
+//
+// Device health and commands.  These never expire.  Commands show up as buttons, but only
+// the ones HA can actually send (no params, no signing).
+//
+func (ha *haDiscovery) announceDevice(cfg DeviceMgmtConfig) {
+	if ha == nil {
+		return
+	}
+
+	healthTopic, ok := ha.stateTopic(cfg.Topic + "health")
+	if !ok {
+		return
+	}
+	cmdTopic, _ := ha.stateTopic(cfg.Topic + "cmd")
+
+	device := &haDevice{
+		Identifiers: []string{ha.gatewayDevice()},
+		Name:        ha.cfg.Node,
+		Model:       "matrix",
+		SWVersion:   version,
+	}
+
+	entities := []struct {
+		id       string
+		template string
+		unit     string
+		class    string
+	}{
+		{"process_uptime", "{{ value_json.processUptime }}", "s", "duration"},
+		{"os_uptime", "{{ value_json.osUptime }}", "s", "duration"},
+		{"load", "{{ value_json.load[0] }}", "", ""},
+		{"memory_available", "{{ value_json.memory.availableKB }}", "kB", "data_size"},
+		{"disk_free", "{{ value_json.disks['/'].free }}", "B", "data_size"},
+		{"cpu_temp", "{{ value_json.cpuTemp }}", "°C", "temperature"},
+		{"throttled", "{{ value_json.throttled.raw | default('0x0') }}", "", ""},
+		{"version", "{{ value_json.version }}", "", ""},
+	}
+
+	for _, e := range entities {
+		payload := &haConfigPayload{
+			Name:           ha.cfg.Node + " " + strings.ReplaceAll(e.id, "_", " "),
+			UniqueID:       ha.gatewayDevice() + "_" + e.id,
+			StateTopic:     healthTopic,
+			ValueTemplate:  e.template,
+			Unit:           e.unit,
+			DeviceClass:    e.class,
+			EntityCategory: "diagnostic",
+			Device:         device,
+		}
+		if len(e.unit) > 0 {
+			payload.StateClass = "measurement"
+		}
+		ha.publishConfig(ha.configTopic("sensor", e.id), payload)
+	}
+
+	for _, command := range cfg.Commands {
+		if len(command.Params) > 0 || len(command.Auth) > 0 {
+			continue
+		}
+		ha.publishConfig(ha.configTopic("button", "cmd_"+haObjectID(command.Name)), &haConfigPayload{
+			Name:         ha.cfg.Node + " " + command.Name,
+			UniqueID:     ha.gatewayDevice() + "_cmd_" + haObjectID(command.Name),
+			CommandTopic: cmdTopic,
+			PayloadPress: command.Name,
+			Device:       device,
+		})
+	}
+}
+
+// haObjectID keeps object IDs to the characters HA is happy with
+func haObjectID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -3,23 +3,54 @@ package main
 import (
 	"math/rand"
 	"sort"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // JobRunnerConfig is a bit of a pain, but in general you can configure raw offsets,
-// random intervals, or fixed intervals.
+// random intervals, or fixed intervals.  Offsets and intervals normally wander a bit
+// within the minute, but setting align runs them right at the top of the minute.
 type JobRunnerCfg struct {
 	Offsets       []int `yaml:"offsets"`
 	RandMin       int   `yaml:"randMin"`
 	RandMax       int   `yaml:"randMax"`
 	EveryStart    int   `yaml:"everyStart"`
 	EveryInterval int   `yaml:"everyInterval"`
+	Align         bool  `yaml:"align"`
 }
 
 type JobRunner interface {
 	Run()
+	Stop()
+}
+
+//
+// jobStopper is the part of every runner that lets it be stopped, even in the middle of a sleep
+//
+type jobStopper struct {
+	quit chan struct{}
+	once sync.Once
+}
+
+func (s *jobStopper) Stop() {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+}
+
+// sleep returns false if the runner was stopped instead
+func (s *jobStopper) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.quit:
+		return false
+	}
 }
 
 func NewJobRunner(name string, cfg JobRunnerCfg, callback func()) JobRunner {
@@ -44,13 +75,15 @@ func NewJobRunner(name string, cfg JobRunnerCfg, callback func()) JobRunner {
 //
 
 type offsetJobRunnerXImpl struct {
+	jobStopper
 	name     string
 	callback func()
 	offsets  []int
+	align    bool
 }
 
 func newOffsetJobRunnerX(name string, cfg JobRunnerCfg, callback func()) JobRunner {
-	r := &offsetJobRunnerXImpl{name: name, callback: callback, offsets: make([]int, 0, 60)}
+	r := &offsetJobRunnerXImpl{jobStopper: jobStopper{quit: make(chan struct{})}, name: name, callback: callback, offsets: make([]int, 0, 60), align: cfg.Align}
 
 	// Copy the offsets from the config
 	tmp := make([]int, 0, 60)
@@ -88,11 +121,12 @@ func (r *offsetJobRunnerXImpl) Run() {
 }
 
 func (r *offsetJobRunnerXImpl) loop() {
-	// Find the next job coming up
+	// Find the next job coming up.  When aligned we can't run in the current minute since
+	// it already started, so look for the one after it.
 	idx := 0
 	minute := time.Now().Minute()
 	for i, offset := range r.offsets {
-		if offset >= minute {
+		if offset > minute || (offset == minute && !r.align) {
 			idx = i
 			break
 		}
@@ -112,8 +146,13 @@ func (r *offsetJobRunnerXImpl) loop() {
 		// Sleep until it is no longer time to sleep.  This adds in some randomness
 		// as well since we don't track seconds.  I think we end up +/- 30 seconds?
 		log.Debugf("job: offset: %s: sleeping %d minutes", r.name, delay)
-		if delay > 0 {
-			time.Sleep(time.Duration(delay) * time.Minute)
+		sleep := time.Duration(delay) * time.Minute
+		if r.align {
+			sleep = time.Until(time.Now().Truncate(time.Minute).Add(sleep))
+		}
+		if !r.sleep(sleep) {
+			log.Debugf("job: offset: %s: stopped", r.name)
+			return
 		}
 
 		// Run the job.  I could confirm we are at the right time, but who cares?
@@ -136,7 +175,7 @@ func (r *offsetJobRunnerXImpl) loop() {
 //
 
 func newIntervalJobRunnerX(name string, cfg JobRunnerCfg, callback func()) JobRunner {
-	r := &offsetJobRunnerXImpl{name: name, callback: callback, offsets: make([]int, 0, 60)}
+	r := &offsetJobRunnerXImpl{jobStopper: jobStopper{quit: make(chan struct{})}, name: name, callback: callback, offsets: make([]int, 0, 60), align: cfg.Align}
 
 	start := cfg.EveryStart
 	if start < 0 || start > 59 {
@@ -161,6 +200,7 @@ func newIntervalJobRunnerX(name string, cfg JobRunnerCfg, callback func()) JobRu
 //
 
 type randomJobRunnerXImpl struct {
+	jobStopper
 	name     string
 	callback func()
 	fixed    int
@@ -177,7 +217,7 @@ func newRandomJobRunnerX(name string, cfg JobRunnerCfg, callback func()) JobRunn
 		random = 5
 	}
 
-	r := &randomJobRunnerXImpl{name: name, callback: callback, fixed: fixed, random: random}
+	r := &randomJobRunnerXImpl{jobStopper: jobStopper{quit: make(chan struct{})}, name: name, callback: callback, fixed: fixed, random: random}
 	return r
 }
 
@@ -199,7 +239,10 @@ func (r *randomJobRunnerXImpl) loop() {
 		}
 
 		log.Debugf("job: random: %s: sleeping %d minutes", r.name, delay)
-		time.Sleep(time.Duration(delay) * time.Minute)
+		if !r.sleep(time.Duration(delay) * time.Minute) {
+			log.Debugf("job: random: %s: stopped", r.name)
+			return
+		}
 
 		r.callback()
 	}
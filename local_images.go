@@ -18,11 +18,12 @@ type LocalImagesConfig struct {
 	Sources []string     `yaml:"sources"`
 }
 
-func initLocalImages(bmux BrokerMux, cfg LocalImagesConfig) {
+func initLocalImages(scope *moduleScope, mmux MatrixMux, cfg LocalImagesConfig) {
 	if len(cfg.Topic) > 0 && len(cfg.Sources) > 0 {
-		NewJobRunner("images-local", cfg.Jobs, func() {
+		health := scope.Health("images-local", 0)
+		scope.NewJobRunner("images-local", cfg.Jobs, func() {
 			index := rand.Intn(len(cfg.Sources))
-			publishLocalImage(bmux, cfg.Topic, cfg.Sources[index], cfg.Height, cfg.Width)
+			health.Result(publishLocalImage(mmux, cfg.Topic, cfg.Sources[index], cfg.Height, cfg.Width))
 		}).Run()
 	}
 }
@@ -48,19 +49,20 @@ func ImageToMatrixBytes(img *image.NRGBA) []byte {
 	return output
 }
 
-func publishLocalImage(bmux BrokerMux, topic string, source string, height int, width int) {
+func publishLocalImage(mmux MatrixMux, topic string, source string, height int, width int) error {
 	img, err := imaging.Open(source)
 	if err != nil {
 		log.Errorf("images-local: %s: open: %v", source, err)
-		return
+		return err
 	}
 
 	final := imaging.Resize(img, width, height, imaging.Lanczos)
 	if err != nil {
 		log.Errorf("images-local: %s: resize: %v", source, err)
-		return
+		return err
 	}
 
 	log.Infof("images-local: posting %s to %s", source, topic)
-	bmux.Publish(topic, 0, false, ImageToMatrixBytes(final))
+	mmux.PublishImage(topic, final)
+	return nil
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceLogConfig forwards log entries at or above level to device/log, so I don't have to
+// ssh in to see what went wrong.  Rate is the most entries per minute, and anything past that
+// is counted and reported with the next one that makes it out.
+type DeviceLogConfig struct {
+	Level string `yaml:"level"`
+	Rate  int    `yaml:"rate"`
+}
+
+// What goes out on device/log
+type forwardedLog struct {
+	Time    string                 `json:"time"`
+	Level   string                 `json:"level"`
+	Msg     string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	Dropped int                    `json:"dropped,omitempty"`
+}
+
+//
+// logForwarder is a logrus hook.  It is always installed, and the device module points it at
+// a topic when it starts and away from it when it stops.  logrus holds its own lock while
+// calling hooks, so Fire can't publish (or log) directly.  Entries go to a goroutine instead.
+// Anything logged about forwarding has logForwardSkip set, so a failed publish can't turn
+// into an endless loop of logging about it.  The mux doesn't log when publishing at all.
+//
+type logForwarder struct {
+	lock    sync.Mutex
+	bmux    BrokerMux
+	topic   string
+	level   log.Level
+	rate    int
+	window  time.Time
+	count   int
+	dropped int
+
+	entries chan forwardedLog
+}
+
+// Log entries with this field are never forwarded
+const logForwardSkip = "noforward"
+
+var logForward = &logForwarder{entries: make(chan forwardedLog, 64)}
+
+func (f *logForwarder) start() {
+	log.AddHook(f)
+	go f.loop()
+}
+
+func (f *logForwarder) attach(bmux BrokerMux, topic string, cfg DeviceLogConfig) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = 30
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.bmux = bmux
+	f.topic = topic
+	f.level = level
+	f.rate = cfg.Rate
+	f.window = time.Time{}
+	f.count = 0
+	f.dropped = 0
+	return nil
+}
+
+func (f *logForwarder) detach() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.bmux = nil
+}
+
+func (f *logForwarder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (f *logForwarder) Fire(entry *log.Entry) error {
+	if _, skip := entry.Data[logForwardSkip]; skip {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Lower is more important in logrus land
+	if f.bmux == nil || entry.Level > f.level {
+		return nil
+	}
+
+	if entry.Time.Sub(f.window) >= time.Minute {
+		f.window = entry.Time
+		f.count = 0
+	}
+	if f.count >= f.rate {
+		f.dropped++
+		return nil
+	}
+
+	out := forwardedLog{
+		Time:    entry.Time.Format(time.RFC3339),
+		Level:   entry.Level.String(),
+		Msg:     entry.Message,
+		Dropped: f.dropped,
+	}
+
+	// Errors marshal to {}, so flatten anything that isn't plain data
+	if len(entry.Data) > 0 {
+		out.Fields = make(map[string]interface{}, len(entry.Data))
+		for k, v := range entry.Data {
+			switch v.(type) {
+			case string, bool, int, int64, float64:
+				out.Fields[k] = v
+			default:
+				out.Fields[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	select {
+	case f.entries <- out:
+		f.count++
+		f.dropped = 0
+	default:
+		f.dropped++
+	}
+
+	return nil
+}
+
+func (f *logForwarder) loop() {
+	for entry := range f.entries {
+		f.lock.Lock()
+		bmux, topic := f.bmux, f.topic
+		f.lock.Unlock()
+
+		if bmux == nil {
+			continue
+		}
+
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			log.WithField(logForwardSkip, true).Errorf("log: %v", err)
+			continue
+		}
+
+		t := bmux.Publish(topic, 0, false, payload)
+		t.WaitTimeout(10 * time.Second)
+		if t.Error() != nil {
+			log.WithField(logForwardSkip, true).Errorf("log: %v", t.Error())
+		}
+	}
+}
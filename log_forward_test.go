@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// nullBrokerMux is somewhere to point things that want a mux but never get far enough to use it
+type nullBrokerMux struct{}
+
+func (nullBrokerMux) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return newErrorToken("null")
+}
+
+func (nullBrokerMux) Subscribe(topic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) mqtt.Token {
+	return newErrorToken("null")
+}
+
+func (nullBrokerMux) Scope() ScopedBrokerMux {
+	return nil
+}
+
+func TestLogForwardFire(t *testing.T) {
+	f := &logForwarder{entries: make(chan forwardedLog, 8)}
+	if err := f.attach(nullBrokerMux{}, "local:device/log", DeviceLogConfig{Level: "warning", Rate: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		entry   *log.Entry
+		forward bool
+	}{
+		{"error", &log.Entry{Time: now, Level: log.ErrorLevel, Message: "a"}, true},
+		{"info", &log.Entry{Time: now, Level: log.InfoLevel, Message: "b"}, false},
+		{"skip", &log.Entry{Time: now, Level: log.ErrorLevel, Message: "c", Data: log.Fields{logForwardSkip: true}}, false},
+		{"warning", &log.Entry{Time: now, Level: log.WarnLevel, Message: "d"}, true},
+		{"over rate", &log.Entry{Time: now, Level: log.ErrorLevel, Message: "e"}, false},
+		{"next minute", &log.Entry{Time: now.Add(time.Minute), Level: log.ErrorLevel, Message: "f"}, true},
+	}
+
+	for _, test := range tests {
+		f.Fire(test.entry)
+		select {
+		case out := <-f.entries:
+			if !test.forward {
+				t.Errorf("%s: forwarded %s", test.name, out.Msg)
+			} else if out.Msg != test.entry.Message {
+				t.Errorf("%s: got %s", test.name, out.Msg)
+			}
+		default:
+			if test.forward {
+				t.Errorf("%s: not forwarded", test.name)
+			}
+		}
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-
-	"gopkg.in/yaml.v2"
 )
 
 //
@@ -23,30 +23,35 @@ type Config struct {
 	//
 	Brokers []BrokerConfig `yaml:"brokers"`
 
+	//
+	// Home Assistant MQTT discovery for the SDR sensors and the device
+	//
+	HomeAssistant HomeAssistantConfig `yaml:"homeassistant"`
+
 	//
 	// Client, which posts uptime and listens for commands.  It also needs a better name.
 	//
 	DeviceMgmt DeviceMgmtConfig `yaml:"device"`
 
 	//
-	// SDR to MQTT.  I suppose this could also be an array some
-	// day when I connect multiple SDRs to a single Pi.
+	// SDR to MQTT, one entry per dongle.  A single entry without the list still works.
 	//
-	SDR SDRConfig `yaml:"sdr"`
+	SDR SDRConfigList `yaml:"sdr"`
 
 	//
-	// Output to LED matrix, which pulls from many sources (including MQTT)
+	// Output to LED matrices, which pull from many sources (including MQTT)
 	//
-	Matrix struct {
-		Weather      WeatherConfig      `yaml:"weather"`
-		TempSensors  []TempSensorConfig `yaml:"sensors"`
-		RemoteImages RemoteImageConfig  `yaml:"remote"`
-		LocalImages  LocalImagesConfig  `yaml:"local"`
-		Strings      StringsConfig      `yaml:"strings"`
-		Mirror       []MirrorConfig     `yaml:"mirror"`
-	} `yaml:"matrix"`
+	Matrix MatrixConfig `yaml:"matrix"`
+
+	//
+	// Fake LED matrix for working on content without walking out to the real one
+	//
+	Emulator EmulatorConfig `yaml:"emulator"`
 }
 
+// How long to wait for publishes to drain when shutting down
+const shutdownTimeout = 10 * time.Second
+
 func handleError(err error) {
 	println(err.Error())
 	usage()
@@ -61,49 +66,46 @@ func usage() {
 // Main
 //
 func main() {
-	var cfg Config
-
 	// Read in the config file
 	cfgPath := "config.yml"
 	if len(os.Args) >= 2 {
 		cfgPath = os.Args[1]
 	}
 
-	f, err := os.Open(cfgPath)
+	// Fire up the brokers and everything that uses them
+	a, err := newApp(cfgPath)
 	if err != nil {
 		handleError(err)
 	}
-	defer f.Close()
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		handleError(err)
-	}
-
-	if cfg.Debug == true {
-		log.Infof("DEBUG")
-		log.SetLevel(log.DebugLevel)
-	}
-
-	// Fire up the brokerMux
-	bmux := newBrokerMux(cfg.Brokers)
-
-	// Fire up the SDR code
-	initSDR(bmux, &cfg.SDR)
-
-	// Fire up some data sources
-	initRemoteImages(bmux, cfg.Matrix.RemoteImages)
-	initTempSensors(bmux, cfg.Matrix.TempSensors)
-	initWeather(bmux, cfg.Matrix.Weather)
-	initLocalImages(bmux, cfg.Matrix.LocalImages)
-	initStrings(bmux, cfg.Matrix.Strings)
-	initMirror(bmux, cfg.Matrix.Mirror)
-
-	// Run the device management code
-	runDeviceMgmt(bmux, cfg.DeviceMgmt)
 
-	// Sit and spin
-	for true {
-		time.Sleep(time.Minute)
+	// Sit and spin, reloading the config whenever someone HUPs us and cleaning up when
+	// asked to leave.  A second TERM/INT while shutting down means someone is impatient.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	done := make(chan struct{})
+	stopping := false
+	for {
+		select {
+		case sig := <-signals:
+			switch {
+			case sig == syscall.SIGHUP:
+				log.Infof("reload: SIGHUP")
+				go a.reload()
+			case stopping:
+				log.Infof("shutdown: %v again, exiting now", sig)
+				os.Exit(1)
+			default:
+				log.Infof("shutdown: %v", sig)
+				stopping = true
+				go func() {
+					a.shutdown(shutdownTimeout)
+					close(done)
+				}()
+			}
+		case <-done:
+			log.Infof("shutdown: done")
+			return
+		}
 	}
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// MatrixOutputConfig picks the payload format for a single matrix topic.  Topics that are
+// not listed get the default format from the display, which is legacy unless told otherwise.
+type MatrixOutputConfig struct {
+	Topic    string   `yaml:"topic"`
+	Format   string   `yaml:"format"`
+	Colors   []string `yaml:"colors"`
+	Duration int      `yaml:"duration"`
+}
+
+//
+// Formats.  Legacy is what the LED matrix has always eaten: text lines separated by ':' with
+// a Latin-1 degree sign, and images as raw RGB bytes.  Control messages are "off" or "on:NN"
+// in legacy land.  JSON is the versioned envelope below.
+//
+const (
+	MatrixFormatLegacy = "legacy"
+	MatrixFormatJSON   = "json"
+)
+
+const matrixEnvelopeVersion = 1
+
+// Bump matrixEnvelopeVersion if any of this changes in a way that breaks old displays
+type matrixEnvelope struct {
+	Type     string       `json:"type"`
+	Version  int          `json:"version"`
+	Lines    []string     `json:"lines,omitempty"`
+	Colors   []string     `json:"colors,omitempty"`
+	Duration int          `json:"duration,omitempty"`
+	Image    *matrixImage `json:"image,omitempty"`
+
+	// Control only
+	Power      string `json:"power,omitempty"`
+	Brightness int    `json:"brightness,omitempty"`
+}
+
+// Data is base64 when marshalled, which is good enough for 6k of pixels
+type matrixImage struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Data   []byte `json:"data"`
+}
+
+// MatrixMux wraps a BrokerMux and knows how each topic on a display wants its payloads
+// formatted.  Topics passed in are relative to the display prefix.
+type MatrixMux interface {
+	PublishText(topic string, lines []string) mqtt.Token
+	PublishImage(topic string, img *image.NRGBA) mqtt.Token
+	PublishRaw(topic string, payload interface{}) mqtt.Token
+	PublishControl(topic string, power bool, brightness int) mqtt.Token
+}
+
+//
+// Init
+//
+func newMatrixMux(bmux BrokerMux, display DisplayConfig) MatrixMux {
+	mmux := &matrixMuxImpl{
+		bmux:    bmux,
+		prefix:  display.Prefix,
+		width:   display.Width,
+		height:  display.Height,
+		outputs: make(map[string]MatrixOutputConfig),
+		defaultOutput: MatrixOutputConfig{
+			Format: checkMatrixFormat(display.Name, display.Format),
+		},
+	}
+
+	for _, output := range display.Outputs {
+		output.Format = checkMatrixFormat(output.Topic, output.Format)
+		log.Debugf("matrix: output: %s%s is %s", display.Prefix, output.Topic, output.Format)
+		mmux.outputs[display.Prefix+output.Topic] = output
+	}
+
+	return mmux
+}
+
+func checkMatrixFormat(name string, format string) string {
+	switch format {
+	case "":
+		return MatrixFormatLegacy
+	case MatrixFormatLegacy, MatrixFormatJSON:
+		return format
+	}
+	log.Errorf("matrix: %s: unknown format %s, using %s", name, format, MatrixFormatLegacy)
+	return MatrixFormatLegacy
+}
+
+//
+// Implementation
+//
+type matrixMuxImpl struct {
+	bmux          BrokerMux
+	prefix        string
+	width         int
+	height        int
+	outputs       map[string]MatrixOutputConfig
+	defaultOutput MatrixOutputConfig
+}
+
+func (mmux *matrixMuxImpl) outputFor(topic string) MatrixOutputConfig {
+	if output, ok := mmux.outputs[topic]; ok {
+		return output
+	}
+	return mmux.defaultOutput
+}
+
+func (mmux *matrixMuxImpl) PublishText(topic string, lines []string) mqtt.Token {
+	topic = mmux.prefix + topic
+	output := mmux.outputFor(topic)
+
+	// Legacy splits lines on ':', so one inside a line (like the time) has to go
+	if output.Format == MatrixFormatLegacy {
+		escaped := make([]string, 0, len(lines))
+		for _, line := range lines {
+			escaped = append(escaped, strings.ReplaceAll(line, ":", "."))
+		}
+		return mmux.bmux.Publish(topic, 0, false, strings.Join(escaped, ":"))
+	}
+
+	envelope := &matrixEnvelope{
+		Type:     "text",
+		Version:  matrixEnvelopeVersion,
+		Lines:    make([]string, 0, len(lines)),
+		Colors:   output.Colors,
+		Duration: output.Duration,
+	}
+	for _, line := range lines {
+		envelope.Lines = append(envelope.Lines, latin1ToUTF8(line))
+	}
+
+	return mmux.publishEnvelope(topic, envelope)
+}
+
+func (mmux *matrixMuxImpl) PublishImage(topic string, img *image.NRGBA) mqtt.Token {
+	topic = mmux.prefix + topic
+	output := mmux.outputFor(topic)
+
+	// Shared sources don't know what they are feeding, so make the image fit this display
+	bounds := img.Bounds()
+	if mmux.width > 0 && mmux.height > 0 && (bounds.Dx() != mmux.width || bounds.Dy() != mmux.height) {
+		img = imaging.Resize(img, mmux.width, mmux.height, imaging.Lanczos)
+	}
+	raw := ImageToMatrixBytes(img)
+
+	if output.Format == MatrixFormatLegacy {
+		return mmux.bmux.Publish(topic, 0, false, raw)
+	}
+
+	envelope := &matrixEnvelope{
+		Type:     "image",
+		Version:  matrixEnvelopeVersion,
+		Duration: output.Duration,
+		Image: &matrixImage{
+			Width:  img.Bounds().Dx(),
+			Height: img.Bounds().Dy(),
+			Format: "rgb24",
+			Data:   raw,
+		},
+	}
+
+	return mmux.publishEnvelope(topic, envelope)
+}
+
+func (mmux *matrixMuxImpl) PublishRaw(topic string, payload interface{}) mqtt.Token {
+	return mmux.bmux.Publish(mmux.prefix+topic, 0, false, payload)
+}
+
+func (mmux *matrixMuxImpl) PublishControl(topic string, power bool, brightness int) mqtt.Token {
+	topic = mmux.prefix + topic
+	output := mmux.outputFor(topic)
+
+	if output.Format == MatrixFormatLegacy {
+		if !power {
+			return mmux.bmux.Publish(topic, 0, false, "off")
+		}
+		return mmux.bmux.Publish(topic, 0, false, fmt.Sprintf("on:%d", brightness))
+	}
+
+	envelope := &matrixEnvelope{
+		Type:    "control",
+		Version: matrixEnvelopeVersion,
+		Power:   "off",
+	}
+	if power {
+		envelope.Power = "on"
+		envelope.Brightness = brightness
+	}
+
+	return mmux.publishEnvelope(topic, envelope)
+}
+
+func (mmux *matrixMuxImpl) publishEnvelope(topic string, envelope *matrixEnvelope) mqtt.Token {
+	out, err := json.Marshal(envelope)
+	if err != nil {
+		log.Errorf("matrix: %s: marshal: %v", topic, err)
+		return newErrorToken(err.Error())
+	}
+	return mmux.bmux.Publish(topic, 0, false, out)
+}
+
+//
+// The text sources still build strings with a raw Latin-1 degree sign since that is what the
+// matrix wants in legacy mode.  JSON has to be UTF-8, so any byte that isn't already part of a
+// valid UTF-8 sequence is assumed to be Latin-1 and converted.  Text from the config file is
+// already UTF-8 and passes through untouched.
+//
+func latin1ToUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	var b strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			r = rune(s[0])
+		}
+		b.WriteRune(r)
+		s = s[size:]
+	}
+	return b.String()
+}
@@ -6,22 +6,25 @@ import (
 )
 
 // MirrorConfig supportd mirroring any topic on any broker to any other topic.  Wildcards
-// work on the sub side, but not on the pub side, of course.
+// work on the sub side, but not on the pub side, of course.  The pub side is relative to
+// the display it is configured under.
 type MirrorConfig struct {
 	Sub string `yaml:"sub"`
 	Pub string `yaml:"pub"`
 }
 
-func initMirror(bmux BrokerMux, cfg []MirrorConfig) {
+func initMirror(scope *moduleScope, mmux MatrixMux, cfg []MirrorConfig) {
 	for _, m := range cfg {
 		m := m
 		log.Infof("mirror: %s -> %s", m.Sub, m.Pub)
 
 		m_copy := m // Make a local copy so we get the right object in the closure
+		health := scope.Health("mirror-"+m.Sub, 0)
 
-		t := bmux.Subscribe(m.Sub, 0, func(client mqtt.Client, msg mqtt.Message) {
+		t := scope.Subscribe(m.Sub, 0, func(client mqtt.Client, msg mqtt.Message) {
 			log.Debugf("mirror: processing %s", m_copy.Sub)
-			go bmux.Publish(m_copy.Pub, 0, false, msg.Payload())
+			health.Beat()
+			go mmux.PublishRaw(m_copy.Pub, msg.Payload())
 		})
 		t.Wait()
 	}
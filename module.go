@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// moduleScope is everything a module (sdr, matrix, etc) started, so it can be torn down and
+// rebuilt on a reload without touching the other modules or the broker connections.  It is a
+// BrokerMux itself, so subscriptions made through it go away with it.  Goroutines that loop
+// forever need to watch Done().
+//
+type moduleScope struct {
+	ScopedBrokerMux
+	name string
+
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	lock  sync.Mutex
+	stops []func()
+}
+
+func newModuleScope(bmux BrokerMux, name string) *moduleScope {
+	return &moduleScope{
+		ScopedBrokerMux: bmux.Scope(),
+		name:            name,
+		quit:            make(chan struct{}),
+	}
+}
+
+// NewJobRunner is NewJobRunner, but the runner gets stopped with the module
+func (m *moduleScope) NewJobRunner(name string, cfg JobRunnerCfg, callback func()) JobRunner {
+	r := NewJobRunner(name, cfg, callback)
+	m.OnStop(r.Stop)
+	return r
+}
+
+// Health registers something that reports to the health registry until the module stops
+func (m *moduleScope) Health(name string, maxAge time.Duration) *healthEntry {
+	h := moduleHealth.register(m.name+"/"+name, maxAge)
+	m.OnStop(func() {
+		moduleHealth.unregister(h)
+	})
+	return h
+}
+
+// Done is closed when the module is stopped
+func (m *moduleScope) Done() <-chan struct{} {
+	return m.quit
+}
+
+// OnStop adds cleanup for things that aren't runners or subscriptions, like child processes
+func (m *moduleScope) OnStop(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stops = append(m.stops, f)
+}
+
+// Stop drops the subscriptions first so nothing new comes in, then cleans up in reverse order
+func (m *moduleScope) Stop() {
+	m.stopOnce.Do(func() {
+		log.Infof("module: %s: stopping", m.name)
+
+		m.ScopedBrokerMux.Close()
+		close(m.quit)
+
+		m.lock.Lock()
+		stops := m.stops
+		m.stops = nil
+		m.lock.Unlock()
+
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"net/http"
 	"strconv"
@@ -37,14 +38,15 @@ type croppedImage struct {
 	width        int
 }
 
-func initRemoteImages(bmux BrokerMux, cfg RemoteImageConfig) {
+func initRemoteImages(scope *moduleScope, mmux MatrixMux, cfg RemoteImageConfig) {
 	if len(cfg.Topic) <= 0 {
 		return
 	}
 
 	for sourceIndex, source := range cfg.Sources {
 		remoteSource := source
-		NewJobRunner("images-remote-"+strconv.Itoa(sourceIndex), source.Jobs, func() {
+		health := scope.Health("images-remote-"+strconv.Itoa(sourceIndex), 0)
+		scope.NewJobRunner("images-remote-"+strconv.Itoa(sourceIndex), source.Jobs, func() {
 			img := &croppedImage{
 				resizeHeight: remoteSource.ResizeHeight,
 				resizeWidth:  remoteSource.ResizeWidth,
@@ -53,7 +55,11 @@ func initRemoteImages(bmux BrokerMux, cfg RemoteImageConfig) {
 				height:       cfg.Height,
 				width:        cfg.Width,
 			}
-			publishRemoteImage(bmux, cfg.Topic, remoteSource.URI, img)
+			err := publishRemoteImage(mmux, cfg.Topic, remoteSource.URI, img)
+			if err != nil {
+				log.Errorf("remoteImage: %v", err)
+			}
+			health.Result(err)
 		}).Run()
 	}
 }
@@ -61,27 +67,24 @@ func initRemoteImages(bmux BrokerMux, cfg RemoteImageConfig) {
 //
 // This is where all of the magic happens
 //
-func publishRemoteImage(bmux BrokerMux, topic string, uri string, img *croppedImage) {
+func publishRemoteImage(mmux MatrixMux, topic string, uri string, img *croppedImage) error {
 	// Read the data
 	var myClient = &http.Client{Timeout: 15 * time.Second}
 
 	rawResp, err := myClient.Get(uri)
 	if err != nil {
-		log.Errorf("remoteImage: GET error: %s: %s", uri, err.Error())
-		return
+		return fmt.Errorf("GET error: %s: %s", uri, err.Error())
 	}
 	defer rawResp.Body.Close()
 
 	if rawResp.StatusCode != http.StatusOK {
-		log.Errorf("remoteImage: GET bad response: %s: %d", uri, rawResp.StatusCode)
-		return
+		return fmt.Errorf("GET bad response: %s: %d", uri, rawResp.StatusCode)
 	}
 
 	// Turn it into an image
 	orig, err := imaging.Decode(rawResp.Body)
 	if err != nil {
-		log.Errorf("remoteImage: bad decode: %s: %v", uri, err)
-		return
+		return fmt.Errorf("bad decode: %s: %v", uri, err)
 	}
 
 	// Resize
@@ -101,5 +104,6 @@ func publishRemoteImage(bmux BrokerMux, topic string, uri string, img *croppedIm
 
 	// Publish whatever we have.
 	log.Infof("remoteImage: posting to %s", topic)
-	bmux.Publish(topic, 0, false, ImageToMatrixBytes(cropped))
+	mmux.PublishImage(topic, cropped)
+	return nil
 }
@@ -4,15 +4,25 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"math"
+	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// SDRConfig contains all of the stuff you can configure for the SDR
+// SDRConfig contains all of the stuff you can configure for the SDR.  Models maps the fields
+// rtl_433 sends to what we publish, and defaults to the weather station fields.  Name is only
+// needed when there is more than one, to tell them apart in logs and health.  Capture saves
+// everything rtl_433 says to a file, which replay can feed back in later without a radio.
 type SDRConfig struct {
+	Name string `yaml:"name"`
+
 	// Publishing
 	Topic    string `yaml:"topic"`
 	Interval int    `yaml:"interval"`
@@ -20,144 +30,242 @@ type SDRConfig struct {
 		Model string `yaml:"model"`
 		ID    int    `yaml:"id"`
 	} `yaml:"allow"`
-
-	// RTL_433
-	RTL433 struct {
-		App       string `yaml:"app"`
-		Protocols []int  `yaml:"protocols"`
-		OnTime    int    `yaml:"onSeconds"`
-		OffTime   int    `yaml:"offSeconds"`
-		Deadman   int    `yaml:"deadman"`
-	} `yaml:"rtl_433"`
+	Models        []SDRModelConfig   `yaml:"models"`
+	Sensors       []SDRSensorConfig  `yaml:"sensors"`
+	Discovery     SDRDiscoveryConfig `yaml:"discovery"`
+	EventTopic    string             `yaml:"eventTopic"`
+	StatsTopic    string             `yaml:"statsTopic"`
+	SilentMinutes int                `yaml:"silentMinutes"`
+
+	// RTL_433, or a replay of what it said some other time
+	RTL433  RTL433Config    `yaml:"rtl_433"`
+	Replay  SDRReplayConfig `yaml:"replay"`
+	Capture string          `yaml:"capture"`
 }
 
-const EmptySensorValue = -999
+// SDRConfigList is one SDRConfig per dongle.  Configs from before there could be more than
+// one have a single SDRConfig instead of a list, so take either.
+type SDRConfigList []SDRConfig
 
-// Incoming raw temp data from rtl_433
-type weatherSensorSDR struct {
-	Model string `json:"model"`
-	ID    int    `json:"id"`
-
-	TemperatureC float32 `json:"temperature_C,omitempty"`
-	TemperatureF float32 `json:"temperature_F,omitempty"`
+func (list *SDRConfigList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var probe interface{}
+	if err := unmarshal(&probe); err != nil {
+		return err
+	}
 
-	Humidity  float32 `json:"humidity,omitempty"`
-	WindSpeed float32 `json:"wind_avg_km_h,omitempty"`
-	WindDir   float32 `json:"wind_dir_deg,omitempty"`
-	Rain      float32 `json:"rain_mm,omitempty"`
-}
+	if _, isList := probe.([]interface{}); isList {
+		var many []SDRConfig
+		if err := unmarshal(&many); err != nil {
+			return err
+		}
+		*list = many
+		return nil
+	}
 
-func createWeatherSensorSDR() weatherSensorSDR {
-	var data weatherSensorSDR
-	data.Model = "Bass-o-matic"
-	data.ID = 0
-	data.TemperatureC = EmptySensorValue
-	data.TemperatureF = EmptySensorValue
-	data.Humidity = EmptySensorValue
-	data.WindSpeed = EmptySensorValue
-	data.WindDir = EmptySensorValue
-	data.Rain = EmptySensorValue
-	return data
+	var one SDRConfig
+	if err := unmarshal(&one); err != nil {
+		return err
+	}
+	*list = SDRConfigList{one}
+	return nil
 }
 
-// Outgoing data to MQTT
-type weatherSensorDataMQTT struct {
-	dirty bool
-	id    int
+// How long to wait before trying rtl_433 again if it won't even start, like when the dongle
+// has been unplugged
+const sdrRestartDelay = time.Minute
 
-	Temperature float32 `json:"temperature"`
-	Humidity    float32 `json:"humidity,omitempty"`
-	WindSpeed   float32 `json:"windSpeed,omitempty"`
-	WindDir     float32 `json:"windDir,omitempty"`
-	Rain        float32 `json:"rain,omitempty"`
+//
+// sdrSensor is everything we've heard from one sensor since it was last published
+//
+type sdrSensor struct {
+	dirty   bool
+	model   string
+	id      int
+	name    string
+	mapping *SDRModelConfig
+	fields  map[string]*sdrField
+
+	// What went out last time, and when
+	published     map[string]interface{}
+	publishedTime time.Time
+
+	// Since we started, for the stats topic
+	packets  int
+	rejected map[string]int
+	signal   sdrSignal
 }
 
-func createWeatherSensorMQTT(id int) *weatherSensorDataMQTT {
-	sensor := &weatherSensorDataMQTT{id: id, dirty: false}
-	sensor.reset()
-	return sensor
+// name is what it gets published as, which is the ID unless it is a named sensor
+func newSDRSensor(model string, id int, name string, mapping *SDRModelConfig) *sdrSensor {
+	return &sdrSensor{
+		model:    model,
+		id:       id,
+		name:     name,
+		mapping:  mapping,
+		fields:   make(map[string]*sdrField),
+		rejected: make(map[string]int),
+	}
 }
 
-func (sensor *weatherSensorDataMQTT) reset() {
-	sensor.Temperature = EmptySensorValue
-	sensor.Humidity = 0
-	sensor.WindSpeed = 0
-	sensor.WindDir = 0
-	sensor.Rain = 0
+func (sensor *sdrSensor) update(raw map[string]interface{}) {
+	sensor.packets++
+	if sensor.mapping.apply(raw, sensor.fields, sensor.rejected) {
+		sensor.dirty = true
+		log.Debugf("dirty: %s:%d", sensor.model, sensor.id)
+	}
 }
 
-func (sensor *weatherSensorDataMQTT) update(incomingData weatherSensorSDR) {
-	if !sensor.dirty {
-		sensor.reset()
+// fields lists the output fields that have data this time around, which is also what HA
+// discovery wants
+func (sensor *sdrSensor) fieldNames() []string {
+	names := make([]string, 0, len(sensor.fields))
+	for name, field := range sensor.fields {
+		if field.count > 0 {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+	return names
+}
 
-	if incomingData.TemperatureC != EmptySensorValue {
-		sensor.Temperature = incomingData.TemperatureC
-		sensor.dirty = true
-	}
-	if incomingData.TemperatureF != EmptySensorValue {
-		sensor.Temperature = (incomingData.TemperatureF - 32.0) * (5.0 / 9.0)
-		sensor.dirty = true
-	}
-	if incomingData.Humidity != EmptySensorValue {
-		sensor.Humidity = incomingData.Humidity
-		sensor.dirty = true
-	}
-	if incomingData.WindSpeed != EmptySensorValue && incomingData.WindDir != EmptySensorValue {
-		sensor.WindSpeed = incomingData.WindSpeed
-		sensor.WindDir = incomingData.WindDir
-		sensor.dirty = true
-	}
-	if incomingData.Rain != EmptySensorValue {
-		sensor.Rain = incomingData.Rain
-		sensor.dirty = true
+func (sensor *sdrSensor) payload() map[string]interface{} {
+	out := make(map[string]interface{}, len(sensor.fields))
+	for name, field := range sensor.fields {
+		if field.count > 0 {
+			out[name] = field.result()
+		}
 	}
-
-	if sensor.dirty {
-		log.Debugf("dirty: %v", sensor)
+	if sensor.mapping.Stats {
+		sensor.addStats(out)
 	}
+	return out
 }
 
-func (sensor *weatherSensorDataMQTT) shouldEmit() bool {
-	log.Debugf("shouldEmit: %v", sensor)
+// shouldEmit is true if there is something new worth publishing.  Either way, the next
+// interval starts fresh.
+func (sensor *sdrSensor) shouldEmit() bool {
+	log.Debugf("shouldEmit: %s:%d", sensor.model, sensor.id)
 
 	dirty := sensor.dirty
 	sensor.dirty = false
-	if dirty && sensor.Temperature != EmptySensorValue {
+	if dirty && sensor.mapping.ready(sensor.fields) && !sensor.suppressed() {
 		log.Debugf("shouldEmit: true")
 		return true
 	}
+	sensor.reset()
 	return false
 }
 
+// suppressed is true if nothing has really changed and the heartbeat isn't due
+func (sensor *sdrSensor) suppressed() bool {
+	heartbeat := time.Duration(sensor.mapping.HeartbeatMinutes) * time.Minute
+	if heartbeat == 0 || time.Since(sensor.publishedTime) >= heartbeat {
+		return false
+	}
+
+	for name, field := range sensor.fields {
+		if field.count == 0 {
+			continue
+		}
+		last, ok := sensor.published[name]
+		if !ok || sensor.moved(name, last, field.result()) {
+			return false
+		}
+	}
+	return true
+}
+
+// pastDeadband is true if a field with a deadband has moved far enough to publish right now
+func (sensor *sdrSensor) pastDeadband() bool {
+	if !sensor.mapping.ready(sensor.fields) {
+		return false
+	}
+
+	for name, field := range sensor.fields {
+		if field.count == 0 || sensor.mapping.deadband(name) == 0 {
+			continue
+		}
+		if last, ok := sensor.published[name]; ok && sensor.moved(name, last, field.result()) {
+			return true
+		}
+	}
+	return false
+}
+
+// moved compares a field to what was published, using the deadband if it has one
+func (sensor *sdrSensor) moved(name string, last interface{}, now interface{}) bool {
+	lastNum, lastOK := last.(float64)
+	nowNum, nowOK := now.(float64)
+	if !lastOK || !nowOK {
+		// Passthrough fields can be lists or objects, which != panics on
+		return !reflect.DeepEqual(last, now)
+	}
+	if deadband := sensor.mapping.deadband(name); deadband > 0 {
+		return math.Abs(nowNum-lastNum) >= deadband
+	}
+	return nowNum != lastNum
+}
+
+func (sensor *sdrSensor) reset() {
+	for _, field := range sensor.fields {
+		field.reset()
+	}
+}
+
 // sdrData just wraps all of the data.  Fancy.
 type sdrData struct {
 	// Config read from yml land
 	sdrCfg *SDRConfig
 
-	// MQTT client we fire up based on the config
-	bmux BrokerMux
+	// What to call this instance in the logs
+	name string
+
+	// Module we belong to, which is also what we publish with
+	scope *moduleScope
+
+	// Home Assistant discovery, which may be nil
+	ha *haDiscovery
 
 	// Map of sensors to allow, if provided.  If this is empty, all are alloed
 	allowMap map[string]bool
 
 	// Map of a sensorHash to the last data we received for said sensor
-	sensors map[string]*weatherSensorDataMQTT
+	sensors map[string]*sdrSensor
+
+	// Named sensors, which get published no matter what the allow list says
+	logicals []*sdrLogical
+
+	// Sensors that the allow list dropped, which may or may not have been reported yet
+	discovered map[string]*sdrDiscovery
 
 	// Channel for accepting incoming sensor data from rtl_433
 	dataChan chan []byte
+
+	// The running rtl_433, so it can be killed when the module stops
+	procLock sync.Mutex
+	proc     *os.Process
+
+	// Where to save everything we hear, if anywhere
+	capture *os.File
+
+	// Beats whenever rtl_433 says anything
+	health *healthEntry
 }
 
-func initSDR(bmux BrokerMux, cfg *SDRConfig) {
+func initSDR(scope *moduleScope, cfg *SDRConfig, ha *haDiscovery) {
 	//
 	// Init the app
 	//
 	data := &sdrData{
-		sdrCfg:   cfg,
-		bmux:     bmux,
-		sensors:  make(map[string]*weatherSensorDataMQTT),
-		allowMap: make(map[string]bool),
-		dataChan: make(chan []byte),
+		sdrCfg:     cfg,
+		name:       "sdr",
+		scope:      scope,
+		ha:         ha,
+		sensors:    make(map[string]*sdrSensor),
+		logicals:   newSDRLogicals(cfg.Sensors),
+		discovered: make(map[string]*sdrDiscovery),
+		allowMap:   make(map[string]bool),
+		dataChan:   make(chan []byte),
 	}
 
 	// See if we even have a topic
@@ -165,13 +273,34 @@ func initSDR(bmux BrokerMux, cfg *SDRConfig) {
 		return
 	}
 
+	healthName := "rtl_433"
+	if len(cfg.Name) > 0 {
+		data.name = "sdr-" + cfg.Name
+		healthName = "rtl_433-" + cfg.Name
+	}
+
 	// Fill in the allow map
 	for _, allow := range cfg.Allow {
 		data.addAllowedSensor(allow.Model, allow.ID)
 	}
+	data.expectSensors()
+	data.loadDiscovered()
 
-	// Fire up the goroutine that manages rtl_433
-	go data.runRTL433()
+	// Nothing from rtl_433 for a few intervals means something is wrong
+	maxAge := 3 * cfg.Interval
+	if maxAge < 30 {
+		maxAge = 30
+	}
+	data.health = scope.Health(healthName, time.Duration(maxAge)*time.Minute)
+
+	// Fire up the goroutine that manages rtl_433, and make sure it dies with us
+	data.openCapture()
+	if len(cfg.Replay.File) > 0 {
+		go data.runReplay()
+	} else {
+		scope.OnStop(data.killRTL433)
+		go data.runRTL433()
+	}
 
 	// Spin forever, emitting processed and rate limited data.  The RTL433
 	// goroutine sends us data via dataChan, so all of the locking is
@@ -183,6 +312,7 @@ func initSDR(bmux BrokerMux, cfg *SDRConfig) {
 			interval = 1
 		}
 		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
 
 		// Loop forever on incoming data and timed publishing
 		for {
@@ -191,6 +321,8 @@ func initSDR(bmux BrokerMux, cfg *SDRConfig) {
 				data.consume(d)
 			case <-ticker.C:
 				data.emit()
+			case <-scope.Done():
+				return
 			}
 		}
 	}()
@@ -200,20 +332,8 @@ func initSDR(bmux BrokerMux, cfg *SDRConfig) {
 // runSDR is a goroutine that fires off rtl_433 and sends the data via a channel
 //
 func (sdr *sdrData) runRTL433() {
-	// Form the args
-	args := []string{"-F", "json", "-C", "si"}
-
-	if sdr.sdrCfg.RTL433.OnTime > 0 {
-		args = append(args, "-T")
-		args = append(args, strconv.Itoa(sdr.sdrCfg.RTL433.OnTime))
-	}
-
-	for _, protocol := range sdr.sdrCfg.RTL433.Protocols {
-		args = append(args, "-R")
-		args = append(args, strconv.Itoa(protocol))
-	}
-
-	log.Infof("sdr: args: %v", args)
+	args := sdr.sdrCfg.RTL433.args()
+	log.Infof("%s: args: %v", sdr.name, args)
 
 	idleLoops := 0
 	active := false
@@ -227,30 +347,61 @@ func (sdr *sdrData) runRTL433() {
 		}
 		cmd := exec.Command(app, args...)
 		stdout, _ := cmd.StdoutPipe()
-		done := make(chan struct{})
+		done := make(chan struct{}, 1)
 		scanner := bufio.NewScanner(stdout)
 
 		// Yet another goroutine to handle the data ...
 		idle := active
 		go func() {
-			log.Debugf("sdr: loop: start")
+			log.Debugf("%s: loop: start", sdr.name)
 			for scanner.Scan() {
 				idle = false
 				active = true
-				sdr.dataChan <- []byte(scanner.Text())
+				sdr.received([]byte(scanner.Text()))
 			}
-			log.Debugf("sdr: loop: end")
+			log.Debugf("%s: loop: end", sdr.name)
 			done <- struct{}{}
 		}()
 
-		// ... while I just sit here
-		if err := cmd.Start(); err != nil {
-			log.Errorf("sdr: start: %v", err)
+		// ... while I just sit here.  The lock makes sure we either start before a stop can
+		// kill us or see the stop and never start.
+		sdr.procLock.Lock()
+		select {
+		case <-sdr.scope.Done():
+			sdr.procLock.Unlock()
 			return
+		default:
 		}
+		if err := cmd.Start(); err != nil {
+			sdr.procLock.Unlock()
+			log.Errorf("%s: start: %v", sdr.name, err)
+			sdr.health.Error(err)
+
+			// Give whatever is wrong a chance to fix itself
+			select {
+			case <-time.After(sdrRestartDelay):
+				continue
+			case <-sdr.scope.Done():
+				return
+			}
+		}
+		sdr.proc = cmd.Process
+		sdr.procLock.Unlock()
 
 		// FIXME: Tight failure loop detection?
 		<-done
+		cmd.Wait()
+
+		sdr.procLock.Lock()
+		sdr.proc = nil
+		sdr.procLock.Unlock()
+
+		select {
+		case <-sdr.scope.Done():
+			log.Infof("%s: stopped", sdr.name)
+			return
+		default:
+		}
 
 		// Attempt to reboot once if the deadman goes off
 		if sdr.sdrCfg.RTL433.Deadman > 0 {
@@ -258,7 +409,7 @@ func (sdr *sdrData) runRTL433() {
 				idleLoops = idleLoops + 1
 				if idleLoops >= sdr.sdrCfg.RTL433.Deadman {
 					sdr.sdrCfg.RTL433.Deadman = 0
-					log.Info("sdr: reboot due to deadman")
+					log.Infof("%s: reboot due to deadman", sdr.name)
 					exec.Command("/bin/bash", "-c", "/usr/bin/sudo /usr/sbin/reboot").Output()
 				}
 			} else {
@@ -268,42 +419,82 @@ func (sdr *sdrData) runRTL433() {
 
 		// Sleep a bit. Duty cycle and all
 		if sdr.sdrCfg.RTL433.OffTime > 0 {
-			time.Sleep(time.Duration(sdr.sdrCfg.RTL433.OffTime) * time.Second)
+			select {
+			case <-time.After(time.Duration(sdr.sdrCfg.RTL433.OffTime) * time.Second):
+			case <-sdr.scope.Done():
+				return
+			}
 		}
 	}
 }
 
+func (sdr *sdrData) killRTL433() {
+	sdr.procLock.Lock()
+	defer sdr.procLock.Unlock()
+
+	if sdr.proc != nil {
+		log.Infof("%s: killing rtl_433", sdr.name)
+		sdr.proc.Kill()
+	}
+}
+
 //
 // consume gets called on the main thread whenever we have new raw data from rtl_433.  This is supposed
 // to be JSON in a format we know, but trust no one.
 //
 func (sdr *sdrData) consume(payload []byte) {
-	incomingData := createWeatherSensorSDR()
+	var raw map[string]interface{}
 
 	// Parse the JSON
-	if err := json.Unmarshal(payload, &incomingData); err != nil {
-		log.Infof("sdr: consume: %v: %v", err, incomingData)
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		log.Infof("%s: consume: %v: %s", sdr.name, err, payload)
+		return
 	}
 
-	// See if we even care
-	if sdr.sensorAllowed(incomingData) == false {
+	model, _ := raw["model"].(string)
+	rawID, ok := sdrNumber(raw["id"])
+	if len(model) == 0 || !ok {
+		log.Debugf("%s: consume: no model or id: %s", sdr.name, payload)
 		return
 	}
-
-	log.Debugf("sdr: consume: %v", incomingData)
+	id := int(rawID)
 
 	// Create a hash.  This doesn't need to be that fancy given the low sensor count, and even
 	// using the ID should be good enough since we're already in a world of hurt if these overlap.
-	hash := fmt.Sprintf("%s:%d", incomingData.Model, incomingData.ID)
+	// Named sensors use the name, so they stay put when the ID changes.
+	hash := fmt.Sprintf("%s:%d", model, id)
+	name := strconv.Itoa(id)
+	if logical := sdr.matchLogical(model, id, raw); logical != nil {
+		hash = logical.cfg.Name
+		name = logical.cfg.Name
+	} else if sdr.sensorAllowed(model, id) == false {
+		// See if we even care
+		sdr.discover(model, id, raw, payload)
+		return
+	}
+
+	log.Debugf("%s: consume: %s", sdr.name, payload)
 
 	// Create the sensor if it is missing
 	sensor, ok := sdr.sensors[hash]
 	if ok != true {
-		sensor = createWeatherSensorMQTT(incomingData.ID)
+		mapping := findSDRModel(sdr.sdrCfg.Models, model, name)
+		if mapping == nil {
+			log.Debugf("%s: consume: no mapping for %s", sdr.name, model)
+			return
+		}
+		sensor = newSDRSensor(model, id, name, mapping)
 		sdr.sensors[hash] = sensor
 	}
 
-	sensor.update(incomingData)
+	sensor.update(raw)
+	sdr.track(sensor, raw)
+
+	// Big changes don't wait for the interval
+	if sensor.pastDeadband() {
+		sensor.dirty = false
+		sdr.publishSensor(sensor)
+	}
 }
 
 //
@@ -311,31 +502,42 @@ func (sdr *sdrData) consume(payload []byte) {
 // accumulating
 //
 func (sdr *sdrData) emit() bool {
+	sdr.reportDiscovered()
 
 	for _, sensor := range sdr.sensors {
-
 		if sensor.shouldEmit() {
-
-			out, err := json.Marshal(sensor)
-			if err != nil {
-				log.Errorf("sdr: emit: %v", err)
-				continue
-			}
-
-			topic := sdr.sdrCfg.Topic + strconv.Itoa(sensor.id)
-			log.Debugf("sdr: emit: %s: %s", topic, out)
-
-			// Fire off another goroutine to send since this is blocking consume()
-			go func() {
-				token := sdr.bmux.Publish(topic, 0, false, out)
-				token.Wait()
-			}()
+			sdr.publishSensor(sensor)
 		}
+		sdr.checkSilent(sensor)
+		sdr.publishStats(sensor)
 	}
 
 	return false
 }
 
+func (sdr *sdrData) publishSensor(sensor *sdrSensor) {
+	payload := sensor.payload()
+	out, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("%s: emit: %v", sdr.name, err)
+		return
+	}
+
+	topic := sdr.sdrCfg.Topic + sensor.name
+	log.Debugf("%s: emit: %s: %s", sdr.name, topic, out)
+
+	sdr.ha.sensorSeen(sensor.model, sensor.name, topic, sensor.fieldNames())
+	sensor.published = payload
+	sensor.publishedTime = time.Now()
+	sensor.reset()
+
+	// Fire off another goroutine to send since this is blocking consume()
+	go func() {
+		token := sdr.scope.Publish(topic, 0, false, out)
+		token.Wait()
+	}()
+}
+
 //
 // Allow lists of sensors to allow.  Allow.
 //
@@ -348,10 +550,10 @@ func (sdr *sdrData) addAllowedSensor(model string, id int) {
 	sdr.allowMap[hash] = true
 }
 
-func (sdr *sdrData) sensorAllowed(sdrJSON weatherSensorSDR) bool {
+func (sdr *sdrData) sensorAllowed(model string, id int) bool {
 	if len(sdr.allowMap) == 0 {
 		return true
 	}
-	_, ok := sdr.allowMap[createAllowFilterHash(sdrJSON.Model, sdrJSON.ID)]
+	_, ok := sdr.allowMap[createAllowFilterHash(model, id)]
 	return ok
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// sdrSignal is how well we hear a sensor, and how it says it is doing.  Battery is nil until
+// the sensor tells us.  Since is when we started expecting to hear from it, which is startup
+// for sensors we were told about and the first packet for everything else.
+//
+type sdrSignal struct {
+	rssi   float64
+	snr    float64
+	noise  float64
+	levels int
+
+	rssiSum float64
+	snrSum  float64
+
+	battery  *bool
+	heard    time.Time
+	since    time.Time
+	silent   bool
+	interval int
+}
+
+// What goes out on the stats topic for each sensor
+type sdrSensorStats struct {
+	Model     string         `json:"model"`
+	ID        int            `json:"id"`
+	Packets   int            `json:"packets"`
+	Interval  int            `json:"intervalPackets"`
+	Rejected  map[string]int `json:"rejected"`
+	LastHeard string         `json:"lastHeard"`
+	BatteryOK *bool          `json:"battery_ok,omitempty"`
+	RSSI      *float64       `json:"rssi,omitempty"`
+	SNR       *float64       `json:"snr,omitempty"`
+	Noise     *float64       `json:"noise,omitempty"`
+	RSSIMean  *float64       `json:"rssiMean,omitempty"`
+	SNRMean   *float64       `json:"snrMean,omitempty"`
+}
+
+// The event that goes out when a battery gets low or a sensor goes quiet, and when it's over
+type sdrAlertEvent struct {
+	Time   string `json:"time"`
+	Event  string `json:"event"`
+	Sensor string `json:"sensor"`
+	Model  string `json:"model"`
+	ID     int    `json:"id"`
+}
+
+//
+// track keeps up with the signal and battery for every packet from a sensor we publish
+//
+func (sdr *sdrData) track(sensor *sdrSensor, raw map[string]interface{}) {
+	signal := &sensor.signal
+	signal.heard = time.Now()
+	signal.interval++
+
+	if signal.silent {
+		signal.silent = false
+		sdr.alert(sensor, "heard")
+	}
+
+	rssi, hasRSSI := sdrNumber(raw["rssi"])
+	snr, hasSNR := sdrNumber(raw["snr"])
+	if hasRSSI && hasSNR {
+		signal.rssi = rssi
+		signal.snr = snr
+		signal.noise, _ = sdrNumber(raw["noise"])
+		signal.rssiSum += rssi
+		signal.snrSum += snr
+		signal.levels++
+	}
+
+	if ok, known := sdrBattery(raw); known {
+		if signal.battery != nil && *signal.battery != ok {
+			if ok {
+				sdr.alert(sensor, "battery_ok")
+			} else {
+				sdr.alert(sensor, "battery_low")
+			}
+		} else if signal.battery == nil && !ok {
+			sdr.alert(sensor, "battery_low")
+		}
+		signal.battery = &ok
+	}
+}
+
+// Some sensors send battery_ok as a level from 0 to 1 instead of just 0 or 1
+const sdrBatteryLow = 0.25
+
+// sdrBattery figures out the battery from battery_ok, or the older battery field
+func sdrBattery(raw map[string]interface{}) (bool, bool) {
+	if v, ok := sdrNumber(raw["battery_ok"]); ok {
+		return v >= sdrBatteryLow, true
+	}
+	if v, ok := raw["battery"].(string); ok {
+		return !strings.EqualFold(v, "low"), true
+	}
+	return false, false
+}
+
+//
+// expectSensors adds the sensors on the allow list and the named ones up front, so they go
+// silent if they're never heard from after a restart.  Anything without a model to publish
+// it with is left out, since it would be dropped when it showed up anyway.
+//
+func (sdr *sdrData) expectSensors() {
+	expect := func(hash string, model string, id int, name string) {
+		if _, ok := sdr.sensors[hash]; ok {
+			return
+		}
+		mapping := findSDRModel(sdr.sdrCfg.Models, model, name)
+		if mapping == nil {
+			return
+		}
+		sensor := newSDRSensor(model, id, name, mapping)
+		sensor.signal.since = time.Now()
+		sdr.sensors[hash] = sensor
+	}
+
+	for _, logical := range sdr.logicals {
+		expect(logical.cfg.Name, logical.cfg.Model, logical.id, logical.cfg.Name)
+	}
+	// An ID that's already a named sensor is only ever heard as the name
+	for _, allow := range sdr.sdrCfg.Allow {
+		if sdr.boundLogical(allow.Model, allow.ID) != nil {
+			continue
+		}
+		expect(createAllowFilterHash(allow.Model, allow.ID), allow.Model, allow.ID, strconv.Itoa(allow.ID))
+	}
+}
+
+// checkSilent gets called every interval to see if anyone has gone quiet on us
+func (sdr *sdrData) checkSilent(sensor *sdrSensor) {
+	silent := time.Duration(sdr.sdrCfg.SilentMinutes) * time.Minute
+	last := sensor.signal.heard
+	if last.IsZero() {
+		last = sensor.signal.since
+	}
+	if silent == 0 || sensor.signal.silent || last.IsZero() {
+		return
+	}
+
+	if time.Since(last) >= silent {
+		sensor.signal.silent = true
+		sdr.alert(sensor, "silent")
+	}
+}
+
+func (sdr *sdrData) alert(sensor *sdrSensor, event string) {
+	log.Infof("%s: %s:%s: %s", sdr.name, sensor.model, sensor.name, event)
+	sdr.publishEvent(sdrAlertEvent{
+		Time:   time.Now().Format(time.RFC3339),
+		Event:  event,
+		Sensor: sensor.name,
+		Model:  sensor.model,
+		ID:     sensor.id,
+	})
+}
+
+func (sdr *sdrData) publishStats(sensor *sdrSensor) {
+	signal := &sensor.signal
+	interval := signal.interval
+	signal.interval = 0
+
+	// Nothing to say about sensors we're still waiting on
+	if len(sdr.sdrCfg.StatsTopic) == 0 || sensor.packets == 0 {
+		return
+	}
+
+	stats := sdrSensorStats{
+		Model:     sensor.model,
+		ID:        sensor.id,
+		Packets:   sensor.packets,
+		Interval:  interval,
+		Rejected:  sensor.rejected,
+		LastHeard: signal.heard.Format(time.RFC3339),
+		BatteryOK: signal.battery,
+	}
+	if signal.levels > 0 {
+		rssi, snr, noise := signal.rssi, signal.snr, signal.noise
+		rssiMean := roundSDR(signal.rssiSum / float64(signal.levels))
+		snrMean := roundSDR(signal.snrSum / float64(signal.levels))
+		stats.RSSI, stats.SNR, stats.Noise = &rssi, &snr, &noise
+		stats.RSSIMean, stats.SNRMean = &rssiMean, &snrMean
+	}
+
+	out, err := json.Marshal(stats)
+	if err != nil {
+		log.Errorf("%s: stats: %v", sdr.name, err)
+		return
+	}
+
+	topic := sdr.sdrCfg.StatsTopic + sensor.name
+	go func() {
+		token := sdr.scope.Publish(topic, 0, true, out)
+		token.Wait()
+	}()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// SDRDiscoveryConfig reports sensors that the allow list is dropping, once each, to topic.  If
+// file is set they are also added to it in the same format as allow, so adding one is a copy
+// and paste, and anything already in there isn't reported again after a restart.
+type SDRDiscoveryConfig struct {
+	Topic string `yaml:"topic"`
+	File  string `yaml:"file"`
+}
+
+//
+// sdrDiscovery is a sensor we've heard but aren't publishing.  It gets reported on the next
+// emit, so the count says something about how often it talks.  Ones that didn't make it into
+// the file are forgotten after a while, since neighbors that pick a new ID on every battery
+// change would otherwise pile up forever.  If they're still around they get reported again.
+//
+type sdrDiscovery struct {
+	Model   string          `json:"model"`
+	ID      int             `json:"id"`
+	Channel interface{}     `json:"channel,omitempty"`
+	Count   int             `json:"count"`
+	First   string          `json:"first"`
+	Last    string          `json:"last"`
+	Packet  json.RawMessage `json:"packet"`
+
+	reported bool
+	forget   time.Time
+}
+
+// How long to remember a reported sensor that isn't in the discovery file
+const sdrDiscoveryForget = 24 * time.Hour
+
+// loadDiscovered fills in what we already know about from the discovery file.  A file that
+// can't be read isn't written to either, since appending to it would only make it worse.
+func (sdr *sdrData) loadDiscovered() {
+	if len(sdr.sdrCfg.Discovery.File) == 0 {
+		return
+	}
+
+	in, err := ioutil.ReadFile(sdr.sdrCfg.Discovery.File)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("%s: discovery: %v, not saving", sdr.name, err)
+		sdr.sdrCfg.Discovery.File = ""
+		return
+	}
+
+	var seen []struct {
+		Model string `yaml:"model"`
+		ID    int    `yaml:"id"`
+	}
+	if err := yaml.Unmarshal(in, &seen); err != nil {
+		log.Errorf("%s: discovery: %s: %v, not saving", sdr.name, sdr.sdrCfg.Discovery.File, err)
+		sdr.sdrCfg.Discovery.File = ""
+		return
+	}
+	for _, sensor := range seen {
+		sdr.discovered[createAllowFilterHash(sensor.Model, sensor.ID)] = &sdrDiscovery{reported: true}
+	}
+}
+
+// discover gets called from consume for everything the allow list drops
+func (sdr *sdrData) discover(model string, id int, raw map[string]interface{}, payload []byte) {
+	if len(sdr.sdrCfg.Discovery.Topic) == 0 {
+		return
+	}
+
+	// Files only know model and ID, so those win if the file says we've seen it
+	hash := createAllowFilterHash(model, id)
+	if sensor, ok := sdr.discovered[hash]; ok && sensor.reported {
+		return
+	}
+	if channel, ok := raw["channel"]; ok {
+		hash = fmt.Sprintf("%s/%v", hash, channel)
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	sensor, ok := sdr.discovered[hash]
+	if ok && sensor.reported {
+		return
+	} else if !ok {
+		sensor = &sdrDiscovery{Model: model, ID: id, Channel: raw["channel"], First: now}
+		sdr.discovered[hash] = sensor
+	}
+	sensor.Count++
+	sensor.Last = now
+	sensor.Packet = json.RawMessage(payload)
+}
+
+// reportDiscovered publishes anything new since the last emit, and forgets old news
+func (sdr *sdrData) reportDiscovered() {
+	now := time.Now()
+	for hash, sensor := range sdr.discovered {
+		if sensor.reported {
+			if !sensor.forget.IsZero() && now.After(sensor.forget) {
+				delete(sdr.discovered, hash)
+			}
+			continue
+		}
+		sensor.reported = true
+
+		out, err := json.Marshal(sensor)
+		if err != nil {
+			log.Errorf("%s: discovery: %v", sdr.name, err)
+			continue
+		}
+		log.Infof("%s: discovered %s:%d", sdr.name, sensor.Model, sensor.ID)
+
+		go func() {
+			token := sdr.scope.Publish(sdr.sdrCfg.Discovery.Topic, 0, false, out)
+			token.Wait()
+		}()
+
+		// The packet was only needed for the report
+		sensor.Packet = nil
+		if len(sdr.sdrCfg.Discovery.File) == 0 {
+			sensor.forget = now.Add(sdrDiscoveryForget)
+		} else if err := sdr.saveDiscovered(sensor); err != nil {
+			log.Errorf("%s: discovery: %v", sdr.name, err)
+			sensor.forget = now.Add(sdrDiscoveryForget)
+		}
+	}
+}
+
+func (sdr *sdrData) saveDiscovered(sensor *sdrDiscovery) error {
+	out, err := os.OpenFile(sdr.sdrCfg.Discovery.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	comment := fmt.Sprintf("# first seen %s, count %d", sensor.First, sensor.Count)
+	if sensor.Channel != nil {
+		comment = fmt.Sprintf("# channel %v, first seen %s, count %d", sensor.Channel, sensor.First, sensor.Count)
+	}
+	_, err = fmt.Fprintf(out, "%s\n- model: %q\n  id: %d\n", comment, sensor.Model, sensor.ID)
+	return err
+}
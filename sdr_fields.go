@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// SDRModelConfig says which rtl_433 fields to publish for a model, and what to call them.  A
+// model of "*" applies to anything without its own entry, and one with sensor set only applies
+// to that sensor (the ID, or the name of a named sensor) and beats the others.  Passthrough also publishes every
+// field that isn't mapped as is, which is handy for figuring out what a new device sends.
+// Nothing is published for a sensor until it has all of the require fields.  With
+// heartbeatMinutes set, readings that haven't changed (by more than the deadband, for fields
+// that have one) aren't published, other than once every heartbeatMinutes to show it's alive.
+// Stats adds the count, min, max and mean of every number over the interval to the payload.
+type SDRModelConfig struct {
+	Model            string            `yaml:"model"`
+	Sensor           string            `yaml:"sensor"`
+	Fields           []SDRFieldMapping `yaml:"fields"`
+	Passthrough      bool              `yaml:"passthrough"`
+	Require          []string          `yaml:"require"`
+	HeartbeatMinutes int               `yaml:"heartbeatMinutes"`
+	Stats            bool              `yaml:"stats"`
+}
+
+// SDRFieldMapping maps one rtl_433 field to one output field.  Convert is one of the named unit
+// conversions below, and scale and offset are applied after that (value*scale + offset, with
+// a scale of 0 meaning 1).  Aggregate is how multiple readings between publishes are combined:
+// last (the default), first, min, max, mean or sum.  Only last and first work on fields that
+// aren't numbers.  Median and ema smooth out the readings in an interval instead, with alpha
+// being how much each new reading counts for (0.3 if not set).  Vector is the average of a
+// direction in degrees, so 350 and 10 come out as 0 and not 180.  A field that moves at least
+// deadband from what was last published gets the sensor published right away instead of
+// waiting for the interval.
+//
+// Readings outside of validMin and validMax are thrown out, as are ones that changed more than
+// maxRate per minute since the last good one.  Those are checked after any conversion.
+type SDRFieldMapping struct {
+	Source    string   `yaml:"source"`
+	Output    string   `yaml:"output"`
+	Convert   string   `yaml:"convert"`
+	Scale     float64  `yaml:"scale"`
+	Offset    float64  `yaml:"offset"`
+	Aggregate string   `yaml:"aggregate"`
+	Alpha     float64  `yaml:"alpha"`
+	Deadband  float64  `yaml:"deadband"`
+	ValidMin  *float64 `yaml:"validMin"`
+	ValidMax  *float64 `yaml:"validMax"`
+	MaxRate   float64  `yaml:"maxRate"`
+}
+
+//
+// The mapping used when nothing is configured, which is what this always did.  rtl_433 runs
+// with -C si, so everything should already be metric, but some devices only report F.
+//
+var defaultSDRModels = []SDRModelConfig{
+	{
+		Model: "*",
+		Fields: []SDRFieldMapping{
+			{Source: "temperature_C", Output: "temperature"},
+			{Source: "temperature_F", Output: "temperature", Convert: "f_to_c"},
+			{Source: "humidity", Output: "humidity"},
+			{Source: "wind_avg_km_h", Output: "windSpeed"},
+			{Source: "wind_dir_deg", Output: "windDir"},
+			{Source: "rain_mm", Output: "rain"},
+		},
+		Require: []string{"temperature"},
+	},
+}
+
+// Fields that identify the sensor, or are about the radio, rather than say anything about the
+// world
+var sdrIdentityFields = map[string]bool{
+	"time":  true,
+	"model": true,
+	"id":    true,
+	"mic":   true,
+	"mod":   true,
+	"freq":  true,
+	"freq1": true,
+	"freq2": true,
+	"rssi":  true,
+	"snr":   true,
+	"noise": true,
+}
+
+var sdrConversions = map[string]func(float64) float64{
+	"f_to_c":      func(v float64) float64 { return (v - 32) * 5 / 9 },
+	"c_to_f":      func(v float64) float64 { return v*9/5 + 32 },
+	"mph_to_kmh":  func(v float64) float64 { return v * 1.609344 },
+	"kmh_to_mph":  func(v float64) float64 { return v / 1.609344 },
+	"ms_to_kmh":   func(v float64) float64 { return v * 3.6 },
+	"in_to_mm":    func(v float64) float64 { return v * 25.4 },
+	"mm_to_in":    func(v float64) float64 { return v / 25.4 },
+	"inhg_to_hpa": func(v float64) float64 { return v * 33.8639 },
+	"kpa_to_hpa":  func(v float64) float64 { return v * 10 },
+}
+
+var sdrAggregates = map[string]bool{
+	"":       true,
+	"last":   true,
+	"first":  true,
+	"min":    true,
+	"max":    true,
+	"mean":   true,
+	"sum":    true,
+	"median": true,
+	"ema":    true,
+	"vector": true,
+}
+
+// checkSDRModels makes sure the mappings make sense before we start
+func checkSDRModels(models []SDRModelConfig) error {
+	for _, model := range models {
+		if model.HeartbeatMinutes < 0 {
+			return fmt.Errorf("sdr: %s: heartbeatMinutes can't be negative", model.Model)
+		}
+		for _, field := range model.Fields {
+			if len(field.Source) == 0 || len(field.Output) == 0 {
+				return fmt.Errorf("sdr: %s: fields need a source and output", model.Model)
+			}
+			if _, ok := sdrConversions[field.Convert]; !ok && len(field.Convert) > 0 {
+				return fmt.Errorf("sdr: %s: %s: unknown convert %s", model.Model, field.Source, field.Convert)
+			}
+			if !sdrAggregates[field.Aggregate] {
+				return fmt.Errorf("sdr: %s: %s: unknown aggregate %s", model.Model, field.Source, field.Aggregate)
+			}
+			if field.Deadband < 0 || field.MaxRate < 0 {
+				return fmt.Errorf("sdr: %s: %s: deadband and maxRate can't be negative", model.Model, field.Source)
+			}
+			if field.Alpha < 0 || field.Alpha > 1 {
+				return fmt.Errorf("sdr: %s: %s: alpha should be between 0 and 1", model.Model, field.Source)
+			}
+			if field.ValidMin != nil && field.ValidMax != nil && *field.ValidMin > *field.ValidMax {
+				return fmt.Errorf("sdr: %s: %s: validMin is more than validMax", model.Model, field.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// findSDRModel returns the mapping for a sensor, then its model, falling back to "*".  With no
+// models configured at all the defaults are used.
+func findSDRModel(models []SDRModelConfig, model string, sensor string) *SDRModelConfig {
+	if len(models) == 0 {
+		models = defaultSDRModels
+	}
+
+	var found, fallback *SDRModelConfig
+	for i := range models {
+		if len(models[i].Sensor) > 0 {
+			if models[i].Sensor == sensor {
+				return &models[i]
+			}
+			continue
+		}
+
+		switch models[i].Model {
+		case model:
+			if found == nil {
+				found = &models[i]
+			}
+		case "*", "":
+			fallback = &models[i]
+		}
+	}
+	if found != nil {
+		return found
+	}
+	return fallback
+}
+
+//
+// apply maps a raw rtl_433 packet onto the sensor's fields.  Readings that don't pass muster
+// are counted in rejected.
+//
+func (model *SDRModelConfig) apply(raw map[string]interface{}, fields map[string]*sdrField, rejected map[string]int) bool {
+	updated := false
+	mapped := make(map[string]bool)
+
+	for _, mapping := range model.Fields {
+		mapped[mapping.Source] = true
+
+		value, ok := raw[mapping.Source]
+		if !ok {
+			continue
+		}
+
+		value, ok = mapping.convert(value)
+		if !ok {
+			continue
+		}
+
+		field, ok := fields[mapping.Output]
+		if !ok {
+			field = &sdrField{aggregate: mapping.Aggregate, alpha: mapping.Alpha}
+			fields[mapping.Output] = field
+		}
+		if !field.accept(&mapping, value, time.Now()) {
+			rejected[mapping.Output]++
+			continue
+		}
+		field.add(value)
+		updated = true
+	}
+
+	if model.Passthrough {
+		for key, value := range raw {
+			if mapped[key] || sdrIdentityFields[key] {
+				continue
+			}
+			field, ok := fields[key]
+			if !ok {
+				field = &sdrField{}
+				fields[key] = field
+			}
+			field.add(value)
+			updated = true
+		}
+	}
+
+	return updated
+}
+
+// ready is true if all of the required fields have something in them
+func (model *SDRModelConfig) ready(fields map[string]*sdrField) bool {
+	for _, name := range model.Require {
+		if field, ok := fields[name]; !ok || field.count == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// deadband is the smallest change in an output field worth publishing early, or 0 for none
+func (model *SDRModelConfig) deadband(output string) float64 {
+	for _, mapping := range model.Fields {
+		if mapping.Output == output && mapping.Deadband > 0 {
+			return mapping.Deadband
+		}
+	}
+	return 0
+}
+
+// convert does the unit conversion and scaling.  Anything that isn't a number passes through
+// untouched, unless it needs converting and isn't even a number in a string.
+func (mapping *SDRFieldMapping) convert(value interface{}) (interface{}, bool) {
+	if len(mapping.Convert) == 0 && mapping.Scale == 0 && mapping.Offset == 0 {
+		return value, true
+	}
+
+	v, isNum := sdrNumber(value)
+	if !isNum {
+		return nil, false
+	}
+
+	if convert, ok := sdrConversions[mapping.Convert]; ok {
+		v = convert(v)
+	}
+	if mapping.Scale != 0 {
+		v = v * mapping.Scale
+	}
+	return v + mapping.Offset, true
+}
+
+// sdrNumber pulls a number out of what JSON gave us, including numbers in strings
+func sdrNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+//
+// sdrField is one output field, aggregating whatever came in since it was last published
+//
+type sdrField struct {
+	aggregate string
+	alpha     float64
+
+	value interface{}
+	count int
+	sum   float64
+	min   float64
+	max   float64
+
+	// Smoothing, and directions
+	samples []float64
+	ema     float64
+	sumSin  float64
+	sumCos  float64
+
+	// The last reading that made it past accept
+	good     float64
+	goodTime time.Time
+	rejects  int
+}
+
+func (field *sdrField) add(value interface{}) {
+	v, isNum := value.(float64)
+
+	if field.count == 0 {
+		field.value = value
+		field.sum = 0
+		field.sumSin = 0
+		field.sumCos = 0
+		field.min = math.Inf(1)
+		field.max = math.Inf(-1)
+	} else if field.aggregate != "first" {
+		field.value = value
+	}
+	field.count++
+
+	if isNum {
+		field.sum += v
+		field.min = math.Min(field.min, v)
+		field.max = math.Max(field.max, v)
+
+		// Only means something if it is a direction, but that's up to whoever reads it
+		field.sumSin += math.Sin(v * math.Pi / 180)
+		field.sumCos += math.Cos(v * math.Pi / 180)
+
+		switch field.aggregate {
+		case "median":
+			field.samples = append(field.samples, v)
+		case "ema":
+			if field.count == 1 {
+				field.ema = v
+			} else {
+				field.ema = field.alphaOrDefault()*v + (1-field.alphaOrDefault())*field.ema
+			}
+		}
+	}
+}
+
+// result is the aggregated value.  Conversions and means make for some ugly decimals, so
+// numbers are rounded to a precision nothing we hear from can actually measure.
+func (field *sdrField) result() interface{} {
+	v, isNum := field.value.(float64)
+	if !isNum {
+		return field.value
+	}
+
+	switch field.aggregate {
+	case "min":
+		v = field.min
+	case "max":
+		v = field.max
+	case "mean":
+		v = field.sum / float64(field.count)
+	case "sum":
+		v = field.sum
+	case "median":
+		v = median(field.samples)
+	case "ema":
+		v = field.ema
+	case "vector":
+		v = field.vectorMean()
+	}
+	return roundSDR(v)
+}
+
+// vectorMean is the average direction in degrees.  Readings either side of north come out a
+// hair under 360 or a hair under 0, which has to round to 0 and not 360.
+func (field *sdrField) vectorMean() float64 {
+	degrees := math.Atan2(field.sumSin, field.sumCos) * 180 / math.Pi
+	degrees = roundSDR(math.Mod(degrees+360, 360))
+	if degrees >= 360 {
+		degrees = 0
+	}
+	return degrees
+}
+
+func roundSDR(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// reset starts a new interval.  The last value is kept in case nothing new shows up.
+func (field *sdrField) reset() {
+	field.count = 0
+	field.samples = field.samples[:0]
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSDRConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping SDRFieldMapping
+		in      interface{}
+		want    interface{}
+		ok      bool
+	}{
+		{"nothing to do", SDRFieldMapping{}, 21.5, 21.5, true},
+		{"string untouched", SDRFieldMapping{}, "CH1", "CH1", true},
+		{"f_to_c", SDRFieldMapping{Convert: "f_to_c"}, 212.0, 100.0, true},
+		{"c_to_f", SDRFieldMapping{Convert: "c_to_f"}, -40.0, -40.0, true},
+		{"mph_to_kmh", SDRFieldMapping{Convert: "mph_to_kmh"}, 10.0, 16.093, true},
+		{"kmh_to_mph", SDRFieldMapping{Convert: "kmh_to_mph"}, 16.09344, 10.0, true},
+		{"ms_to_kmh", SDRFieldMapping{Convert: "ms_to_kmh"}, 10.0, 36.0, true},
+		{"in_to_mm", SDRFieldMapping{Convert: "in_to_mm"}, 2.0, 50.8, true},
+		{"mm_to_in", SDRFieldMapping{Convert: "mm_to_in"}, 25.4, 1.0, true},
+		{"inhg_to_hpa", SDRFieldMapping{Convert: "inhg_to_hpa"}, 30.0, 1015.917, true},
+		{"kpa_to_hpa", SDRFieldMapping{Convert: "kpa_to_hpa"}, 101.3, 1013.0, true},
+		{"scale", SDRFieldMapping{Scale: 0.1}, 215.0, 21.5, true},
+		{"offset", SDRFieldMapping{Offset: -1.5}, 21.5, 20.0, true},
+		{"convert then scale then offset", SDRFieldMapping{Convert: "f_to_c", Scale: 2, Offset: 1}, 212.0, 201.0, true},
+		{"number in a string", SDRFieldMapping{Convert: "kpa_to_hpa"}, "101.3", 1013.0, true},
+		{"not a number", SDRFieldMapping{Convert: "f_to_c"}, "hot", nil, false},
+		{"bool", SDRFieldMapping{Scale: 2}, true, nil, false},
+	}
+
+	for _, test := range tests {
+		got, ok := test.mapping.convert(test.in)
+		if ok != test.ok {
+			t.Errorf("%s: ok %v", test.name, ok)
+			continue
+		}
+		if v, isNum := got.(float64); isNum {
+			got = roundSDR(v)
+		}
+		if ok && got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSDRAggregates(t *testing.T) {
+	tests := []struct {
+		aggregate string
+		want      float64
+	}{
+		{"", 2},
+		{"last", 2},
+		{"first", 4},
+		{"min", 1},
+		{"max", 4},
+		{"mean", 2.333},
+		{"sum", 7},
+	}
+
+	for _, test := range tests {
+		field := &sdrField{aggregate: test.aggregate}
+		for _, v := range []float64{4, 1, 2} {
+			field.add(v)
+		}
+		if got := field.result(); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.aggregate, got, test.want)
+		}
+	}
+}
+
+func TestSDRFieldReset(t *testing.T) {
+	// A new interval starts over, but the last value sticks around until something new comes in
+	field := &sdrField{aggregate: "max"}
+	field.add(10.0)
+	field.reset()
+	if got := field.result(); got != 10.0 {
+		t.Errorf("after reset: got %v", got)
+	}
+
+	field.add(3.0)
+	if got := field.result(); got != 3.0 {
+		t.Errorf("new interval: got %v", got)
+	}
+
+	// Non-numbers just pass through whatever the aggregate
+	field = &sdrField{aggregate: "sum"}
+	field.add("CH1")
+	field.add("CH2")
+	if got := field.result(); got != "CH2" {
+		t.Errorf("string: got %v", got)
+	}
+}
+
+func TestFindSDRModel(t *testing.T) {
+	models := []SDRModelConfig{
+		{Model: "Acurite-Tower", Require: []string{"first"}},
+		{Model: "Acurite-Tower", Require: []string{"second"}},
+		{Model: "Acurite-Tower", Sensor: "porch", Require: []string{"porch"}},
+		{Model: "*", Require: []string{"fallback"}},
+	}
+
+	tests := []struct {
+		name   string
+		models []SDRModelConfig
+		model  string
+		sensor string
+		want   string
+	}{
+		{"model", models, "Acurite-Tower", "1234", "first"},
+		{"sensor wins", models, "Acurite-Tower", "porch", "porch"},
+		{"sensor on another model", models, "LaCrosse-TX141", "porch", "porch"},
+		{"fallback", models, "LaCrosse-TX141", "1234", "fallback"},
+		{"defaults", nil, "LaCrosse-TX141", "1234", "temperature"},
+		{"no fallback", models[:2], "LaCrosse-TX141", "1234", ""},
+	}
+
+	for _, test := range tests {
+		found := findSDRModel(test.models, test.model, test.sensor)
+		got := ""
+		if found != nil {
+			got = found.Require[0]
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSDRApply(t *testing.T) {
+	model := &SDRModelConfig{
+		Fields: []SDRFieldMapping{
+			{Source: "temperature_F", Output: "temperature", Convert: "f_to_c"},
+			{Source: "humidity", Output: "humidity"},
+		},
+		Require:     []string{"temperature"},
+		Passthrough: true,
+	}
+	raw := map[string]interface{}{
+		"time":          "2024-01-01 00:00:00",
+		"model":         "Acurite-Tower",
+		"id":            1234.0,
+		"rssi":          -12.0,
+		"temperature_F": 212.0,
+		"channel":       "A",
+	}
+
+	fields := make(map[string]*sdrField)
+	rejected := make(map[string]int)
+	if !model.apply(raw, fields, rejected) {
+		t.Fatal("nothing applied")
+	}
+	if !model.ready(fields) {
+		t.Error("not ready with temperature")
+	}
+
+	// Mapped fields by output name, passthrough as is, and nothing about the radio
+	got := make(map[string]interface{})
+	for name, field := range fields {
+		got[name] = field.result()
+	}
+	want := map[string]interface{}{"temperature": 100.0, "channel": "A"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Missing the required field
+	fields = make(map[string]*sdrField)
+	model.apply(map[string]interface{}{"humidity": 50.0}, fields, rejected)
+	if model.ready(fields) {
+		t.Error("ready without temperature")
+	}
+}
+
+func TestCheckSDRModels(t *testing.T) {
+	low, high := 10.0, 0.0
+	tests := []struct {
+		name  string
+		field SDRFieldMapping
+		ok    bool
+	}{
+		{"good", SDRFieldMapping{Source: "a", Output: "b", Convert: "f_to_c", Aggregate: "mean"}, true},
+		{"no source", SDRFieldMapping{Output: "b"}, false},
+		{"no output", SDRFieldMapping{Source: "a"}, false},
+		{"unknown convert", SDRFieldMapping{Source: "a", Output: "b", Convert: "c_to_k"}, false},
+		{"unknown aggregate", SDRFieldMapping{Source: "a", Output: "b", Aggregate: "mode"}, false},
+		{"negative deadband", SDRFieldMapping{Source: "a", Output: "b", Deadband: -1}, false},
+		{"negative maxRate", SDRFieldMapping{Source: "a", Output: "b", MaxRate: -1}, false},
+		{"alpha too big", SDRFieldMapping{Source: "a", Output: "b", Alpha: 1.5}, false},
+		{"min over max", SDRFieldMapping{Source: "a", Output: "b", ValidMin: &low, ValidMax: &high}, false},
+	}
+
+	for _, test := range tests {
+		err := checkSDRModels([]SDRModelConfig{{Model: "x", Fields: []SDRFieldMapping{test.field}}})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+	if err := checkSDRModels([]SDRModelConfig{{Model: "x", HeartbeatMinutes: -1}}); err == nil {
+		t.Error("negative heartbeat: want an error")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// A reading that keeps failing the rate check is probably real, so it is taken after this many
+// in a row.  Otherwise one bad reading that got in first would lock out all of the good ones.
+const sdrMaxRejects = 3
+
+// How much a new reading counts for in an ema if the config doesn't say
+const sdrDefaultAlpha = 0.3
+
+//
+// accept decides if a reading is believable.  Anything that isn't a number is.
+//
+func (field *sdrField) accept(mapping *SDRFieldMapping, value interface{}, now time.Time) bool {
+	v, isNum := value.(float64)
+	if !isNum {
+		return true
+	}
+
+	if (mapping.ValidMin != nil && v < *mapping.ValidMin) || (mapping.ValidMax != nil && v > *mapping.ValidMax) {
+		return false
+	}
+
+	if mapping.MaxRate > 0 && !field.goodTime.IsZero() && field.rejects < sdrMaxRejects {
+		// Sensors tend to repeat themselves a few times in the same second
+		minutes := math.Max(now.Sub(field.goodTime).Minutes(), 1.0/60)
+		if math.Abs(v-field.good)/minutes > mapping.MaxRate {
+			field.rejects++
+			return false
+		}
+	}
+
+	field.good = v
+	field.goodTime = now
+	field.rejects = 0
+	return true
+}
+
+func (field *sdrField) alphaOrDefault() float64 {
+	if field.alpha > 0 {
+		return field.alpha
+	}
+	return sdrDefaultAlpha
+}
+
+func median(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+//
+// Interval stats, for models that want them.  Directions only get a mean, since the min and
+// max of an angle don't mean much.
+//
+type sdrFieldStats struct {
+	Count int      `json:"count"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Mean  float64  `json:"mean"`
+}
+
+// Output fields that get special treatment in the stats
+const (
+	sdrWindSpeedField = "windSpeed"
+	sdrWindDirField   = "windDir"
+)
+
+func (sensor *sdrSensor) addStats(out map[string]interface{}) {
+	stats := make(map[string]sdrFieldStats)
+	for name, field := range sensor.fields {
+		if _, isNum := field.value.(float64); !isNum || field.count == 0 {
+			continue
+		}
+
+		if field.aggregate == "vector" || name == sdrWindDirField {
+			stats[name] = sdrFieldStats{Count: field.count, Mean: roundSDR(field.vectorMean())}
+			continue
+		}
+
+		min := roundSDR(field.min)
+		max := roundSDR(field.max)
+		stats[name] = sdrFieldStats{
+			Count: field.count,
+			Min:   &min,
+			Max:   &max,
+			Mean:  roundSDR(field.sum / float64(field.count)),
+		}
+	}
+	out["stats"] = stats
+
+	// No max if someone set windSpeed to the vector aggregate
+	if wind, ok := stats[sdrWindSpeedField]; ok && wind.Max != nil {
+		out["windGust"] = *wind.Max
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSDRAcceptRange(t *testing.T) {
+	low, high := -40.0, 60.0
+	mapping := &SDRFieldMapping{ValidMin: &low, ValidMax: &high}
+
+	tests := []struct {
+		value interface{}
+		ok    bool
+	}{
+		{20.0, true},
+		{-40.0, true},
+		{60.0, true},
+		{60.1, false},
+		{-41.0, false},
+		{"CH1", true},
+	}
+
+	for _, test := range tests {
+		field := &sdrField{}
+		if got := field.accept(mapping, test.value, time.Now()); got != test.ok {
+			t.Errorf("%v: got %v", test.value, got)
+		}
+	}
+}
+
+func TestSDRAcceptRate(t *testing.T) {
+	mapping := &SDRFieldMapping{MaxRate: 2}
+	field := &sdrField{}
+	start := time.Now()
+
+	// In order, since each one that gets in is what the next is compared to
+	tests := []struct {
+		name  string
+		after time.Duration
+		value float64
+		ok    bool
+	}{
+		{"first", 0, 20, true},
+		{"repeat in the same second", 0, 20, true},
+		{"slow change", time.Minute, 21.5, true},
+		{"too fast", time.Minute, 25, false},
+		{"too fast again", time.Minute + time.Second, 40, false},
+		{"too fast a third time", time.Minute + 2*time.Second, 40, false},
+		{"probably real", time.Minute + 3*time.Second, 40, true},
+		{"checked from the new value", 2 * time.Minute, 41, true},
+		{"too fast from the new value", 2 * time.Minute, 30, false},
+		{"after a long gap", 20 * time.Minute, 30, true},
+	}
+
+	for _, test := range tests {
+		if got := field.accept(mapping, test.value, start.Add(test.after)); got != test.ok {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
+
+func TestSDRRejectsCounted(t *testing.T) {
+	high := 100.0
+	model := &SDRModelConfig{Fields: []SDRFieldMapping{{Source: "humidity", Output: "humidity", ValidMax: &high}}}
+	fields := make(map[string]*sdrField)
+	rejected := make(map[string]int)
+
+	if model.apply(map[string]interface{}{"humidity": 255.0}, fields, rejected) {
+		t.Error("applied a rejected reading")
+	}
+	model.apply(map[string]interface{}{"humidity": 40.0}, fields, rejected)
+	model.apply(map[string]interface{}{"humidity": 255.0}, fields, rejected)
+
+	if rejected["humidity"] != 2 {
+		t.Errorf("got %d rejects", rejected["humidity"])
+	}
+	if got := fields["humidity"].result(); got != 40.0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestSDRSmoothing(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  sdrField
+		values []float64
+		want   float64
+	}{
+		{"median odd", sdrField{aggregate: "median"}, []float64{5, 1, 3}, 3},
+		{"median even", sdrField{aggregate: "median"}, []float64{4, 1, 3, 2}, 2.5},
+		{"median spike", sdrField{aggregate: "median"}, []float64{20, 20.1, 85, 20.2, 20}, 20.1},
+		{"ema", sdrField{aggregate: "ema", alpha: 0.5}, []float64{4, 1, 2}, 2.25},
+		{"ema default alpha", sdrField{aggregate: "ema"}, []float64{10, 0}, 7},
+		{"ema one", sdrField{aggregate: "ema", alpha: 0.5}, []float64{4}, 4},
+	}
+
+	for _, test := range tests {
+		field := test.field
+		for _, v := range test.values {
+			field.add(v)
+		}
+		if got := field.result(); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Each interval gets its own median
+	field := &sdrField{aggregate: "median"}
+	field.add(100.0)
+	field.reset()
+	field.add(1.0)
+	field.add(2.0)
+	if got := field.result(); got != 1.5 {
+		t.Errorf("after reset: got %v", got)
+	}
+
+	if got := median(nil); got != 0 {
+		t.Errorf("empty: got %v", got)
+	}
+}
+
+func TestSDRVectorMean(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{[]float64{350, 10}, 0},
+		{[]float64{10, 350}, 0},
+		{[]float64{359, 1}, 0},
+		{[]float64{0, 0}, 0},
+		{[]float64{80, 100}, 90},
+		{[]float64{170, 190}, 180},
+		{[]float64{260, 280}, 270},
+		{[]float64{340, 350, 360, 10}, 355},
+		{[]float64{45}, 45},
+	}
+
+	for _, test := range tests {
+		field := &sdrField{aggregate: "vector"}
+		for _, v := range test.values {
+			field.add(v)
+		}
+		if got := field.result(); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestSDRStats(t *testing.T) {
+	model := &SDRModelConfig{
+		Fields: []SDRFieldMapping{
+			{Source: "temperature_C", Output: "temperature"},
+			{Source: "wind_avg_km_h", Output: "windSpeed"},
+			{Source: "wind_dir_deg", Output: "windDir"},
+			{Source: "model", Output: "name"},
+		},
+		Stats: true,
+	}
+	sensor := newSDRSensor("M", 1, "1", model)
+	for _, raw := range []map[string]interface{}{
+		{"temperature_C": 20.0, "wind_avg_km_h": 10.0, "wind_dir_deg": 350.0, "model": "M"},
+		{"temperature_C": 22.0, "wind_avg_km_h": 30.0, "wind_dir_deg": 10.0, "model": "M"},
+		{"temperature_C": 21.0, "wind_avg_km_h": 20.0, "model": "M"},
+	} {
+		sensor.update(raw)
+	}
+
+	out := sensor.payload()
+	stats, ok := out["stats"].(map[string]sdrFieldStats)
+	if !ok {
+		t.Fatalf("no stats: %v", out)
+	}
+
+	temperature := stats["temperature"]
+	if temperature.Count != 3 || *temperature.Min != 20 || *temperature.Max != 22 || temperature.Mean != 21 {
+		t.Errorf("temperature: %+v", temperature)
+	}
+
+	// Directions only get a mean, and it goes around north
+	windDir := stats["windDir"]
+	if windDir.Count != 2 || windDir.Min != nil || windDir.Max != nil || windDir.Mean != 0 {
+		t.Errorf("windDir: %+v", windDir)
+	}
+
+	if out["windGust"] != 30.0 {
+		t.Errorf("windGust: %v", out["windGust"])
+	}
+	if _, ok := stats["name"]; ok {
+		t.Error("stats for a string")
+	}
+
+	// Without stats set it's just the values
+	model.Stats = false
+	if _, ok := sensor.payload()["stats"]; ok {
+		t.Error("stats without stats set")
+	}
+}
+
+func TestSDRStatsVectorWind(t *testing.T) {
+	// Speed averaged as a vector has no max, so no gust either
+	model := &SDRModelConfig{
+		Fields: []SDRFieldMapping{{Source: "wind_avg_km_h", Output: "windSpeed", Aggregate: "vector"}},
+		Stats:  true,
+	}
+	sensor := newSDRSensor("M", 1, "1", model)
+	sensor.update(map[string]interface{}{"wind_avg_km_h": 10.0})
+
+	out := sensor.payload()
+	if _, ok := out["windGust"]; ok {
+		t.Errorf("windGust: %v", out["windGust"])
+	}
+}
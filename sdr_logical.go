@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SDRSensorConfig gives a sensor a name that survives it picking a new ID, which a lot of them
+// do after a battery change.  The name is what gets published instead of the ID.  Model is
+// required, and then either channel (for sensors with a switch on the back) or learnMinutes
+// decides what to do with a new ID.  Once the current ID has been quiet for learnMinutes, the
+// next new ID of the same model (and channel, if set) is taken.  Without a channel that is
+// anything of the same model, so don't use it if the neighbors have the same thing.  Channels
+// wait sdrChannelQuiet if learnMinutes isn't set, since there are only so many of them.  ID is
+// the one to start with, otherwise the first one that matches is used.
+type SDRSensorConfig struct {
+	Name         string `yaml:"name"`
+	Model        string `yaml:"model"`
+	Channel      string `yaml:"channel"`
+	ID           int    `yaml:"id"`
+	LearnMinutes int    `yaml:"learnMinutes"`
+}
+
+// How long a named sensor with a channel has to be quiet before someone else on that channel
+// can have the name
+const sdrChannelQuiet = 10 * time.Minute
+
+//
+// sdrLogical is where a named sensor is at right now
+//
+type sdrLogical struct {
+	cfg   SDRSensorConfig
+	id    int
+	bound bool
+	heard time.Time
+}
+
+// The event that goes out when a named sensor switches IDs
+type sdrRebindEvent struct {
+	Time   string `json:"time"`
+	Event  string `json:"event"`
+	Sensor string `json:"sensor"`
+	Model  string `json:"model"`
+	OldID  int    `json:"oldId,omitempty"`
+	NewID  int    `json:"newId"`
+}
+
+func checkSDRSensors(sensors []SDRSensorConfig) error {
+	names := make(map[string]bool)
+	for _, sensor := range sensors {
+		if len(sensor.Name) == 0 || len(sensor.Model) == 0 {
+			return errors.New("sdr: sensors need a name and model")
+		}
+		if names[sensor.Name] {
+			return fmt.Errorf("sdr: duplicate sensor %s", sensor.Name)
+		}
+		names[sensor.Name] = true
+		if sensor.LearnMinutes < 0 {
+			return fmt.Errorf("sdr: %s: learnMinutes can't be negative", sensor.Name)
+		}
+	}
+	return nil
+}
+
+func newSDRLogicals(cfgs []SDRSensorConfig) []*sdrLogical {
+	logicals := make([]*sdrLogical, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		logicals = append(logicals, &sdrLogical{
+			cfg:   cfg,
+			id:    cfg.ID,
+			bound: cfg.ID != 0,
+			heard: time.Now(),
+		})
+	}
+	return logicals
+}
+
+//
+// matchLogical finds the named sensor a packet belongs to, if any, rebinding it if the ID is
+// new.  Sensors already using the ID win, then the allow list, then channel matches, then
+// anything learning.
+//
+func (sdr *sdrData) matchLogical(model string, id int, raw map[string]interface{}) *sdrLogical {
+	if logical := sdr.boundLogical(model, id); logical != nil {
+		logical.heard = time.Now()
+		return logical
+	}
+
+	// Anything on the allow list is already spoken for
+	if sdr.allowMap[createAllowFilterHash(model, id)] {
+		return nil
+	}
+
+	channel, hasChannel := raw["channel"]
+	for _, logical := range sdr.logicals {
+		if logical.cfg.Model != model || len(logical.cfg.Channel) == 0 {
+			continue
+		}
+		if hasChannel && fmt.Sprint(channel) == logical.cfg.Channel && logical.learning(sdrChannelQuiet) {
+			sdr.rebind(logical, id)
+			return logical
+		}
+	}
+
+	for _, logical := range sdr.logicals {
+		if logical.cfg.Model != model || len(logical.cfg.Channel) > 0 {
+			continue
+		}
+		if logical.learning(0) {
+			sdr.rebind(logical, id)
+			return logical
+		}
+	}
+
+	return nil
+}
+
+// boundLogical is the named sensor using an ID right now, if any
+func (sdr *sdrData) boundLogical(model string, id int) *sdrLogical {
+	for _, logical := range sdr.logicals {
+		if logical.bound && logical.id == id && logical.cfg.Model == model {
+			return logical
+		}
+	}
+	return nil
+}
+
+// learning is true if the sensor can take a new ID, which is when it doesn't have one or the
+// one it has has been quiet long enough
+func (logical *sdrLogical) learning(quiet time.Duration) bool {
+	if logical.cfg.LearnMinutes > 0 {
+		quiet = time.Duration(logical.cfg.LearnMinutes) * time.Minute
+	}
+	return !logical.bound || (quiet > 0 && time.Since(logical.heard) > quiet)
+}
+
+func (sdr *sdrData) rebind(logical *sdrLogical, id int) {
+	event := sdrRebindEvent{
+		Time:   time.Now().Format(time.RFC3339),
+		Event:  "rebind",
+		Sensor: logical.cfg.Name,
+		Model:  logical.cfg.Model,
+		NewID:  id,
+	}
+	if logical.bound {
+		event.OldID = logical.id
+	}
+
+	log.Infof("%s: %s is now %s:%d", sdr.name, logical.cfg.Name, logical.cfg.Model, id)
+	logical.id = id
+	logical.bound = true
+	logical.heard = time.Now()
+
+	if sensor, ok := sdr.sensors[logical.cfg.Name]; ok {
+		sensor.id = id
+	}
+
+	sdr.publishEvent(event)
+}
+
+// publishEvent sends things worth knowing about to the event topic, if there is one
+func (sdr *sdrData) publishEvent(event interface{}) {
+	if len(sdr.sdrCfg.EventTopic) == 0 {
+		return
+	}
+
+	out, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("%s: event: %v", sdr.name, err)
+		return
+	}
+
+	go func() {
+		token := sdr.scope.Publish(sdr.sdrCfg.EventTopic, 1, false, out)
+		token.Wait()
+	}()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchLogical(t *testing.T) {
+	cfg := `
+topic: "local:sensors/"
+allow:
+  - model: "M"
+    id: 99
+sensors:
+  - name: "porch"
+    model: "M"
+    channel: "A"
+    id: 10
+  - name: "shed"
+    model: "M"
+    id: 20
+    learnMinutes: 30
+  - name: "garage"
+    model: "N"
+  - name: "side"
+    model: "C"
+    channel: "1"
+    id: 30
+`
+
+	tests := []struct {
+		name    string
+		quiet   []string
+		model   string
+		id      int
+		channel interface{}
+		want    string
+	}{
+		{"bound", nil, "M", 10, "A", "porch"},
+		{"bound on another channel", nil, "M", 10, "B", "porch"},
+		{"bound without a channel", nil, "M", 20, nil, "shed"},
+		{"other model", []string{"porch", "shed"}, "X", 10, "A", ""},
+		{"channel still talking", nil, "M", 11, "A", ""},
+		{"channel gone quiet", []string{"porch"}, "M", 11, "A", "porch"},
+		{"no channel in the packet", []string{"porch"}, "M", 11, nil, ""},
+		{"other channel", []string{"porch"}, "M", 11, "B", ""},
+		{"allowed on the channel", []string{"porch", "shed"}, "M", 99, "A", ""},
+		{"learning still talking", nil, "M", 21, nil, ""},
+		{"learning gone quiet", []string{"shed"}, "M", 21, nil, "shed"},
+		{"channel before learning", []string{"porch", "shed"}, "M", 12, "A", "porch"},
+		{"learning on another channel", []string{"porch", "shed"}, "M", 12, "B", "shed"},
+		{"unbound", nil, "N", 5, nil, "garage"},
+		{"numeric channel", []string{"side"}, "C", 31, float64(1), "side"},
+	}
+
+	for _, test := range tests {
+		sdr, _ := newTestSDR(testSDRConfig(t, cfg))
+		for _, logical := range sdr.logicals {
+			for _, name := range test.quiet {
+				if logical.cfg.Name == name {
+					logical.heard = time.Now().Add(-time.Hour)
+				}
+			}
+		}
+
+		raw := map[string]interface{}{"model": test.model, "id": float64(test.id)}
+		if test.channel != nil {
+			raw["channel"] = test.channel
+		}
+
+		got := ""
+		if logical := sdr.matchLogical(test.model, test.id, raw); logical != nil {
+			got = logical.cfg.Name
+			if logical.id != test.id || !logical.bound {
+				t.Errorf("%s: bound to %d", test.name, logical.id)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchLogicalSticks(t *testing.T) {
+	// Once a learning sensor takes an ID it keeps it until that one goes quiet
+	sdr, _ := newTestSDR(testSDRConfig(t, `
+sensors:
+  - name: "garage"
+    model: "N"
+`))
+
+	if logical := sdr.matchLogical("N", 5, map[string]interface{}{}); logical == nil {
+		t.Fatal("5 wasn't taken")
+	}
+	if logical := sdr.matchLogical("N", 6, map[string]interface{}{}); logical != nil {
+		t.Errorf("6 took %s", logical.cfg.Name)
+	}
+	if logical := sdr.matchLogical("N", 5, map[string]interface{}{}); logical == nil || logical.id != 5 {
+		t.Error("lost 5")
+	}
+}
+
+func TestCheckSDRSensors(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensors []SDRSensorConfig
+		ok      bool
+	}{
+		{"good", []SDRSensorConfig{{Name: "a", Model: "M"}, {Name: "b", Model: "M"}}, true},
+		{"no name", []SDRSensorConfig{{Model: "M"}}, false},
+		{"no model", []SDRSensorConfig{{Name: "a"}}, false},
+		{"duplicate", []SDRSensorConfig{{Name: "a", Model: "M"}, {Name: "a", Model: "N"}}, false},
+		{"negative learn", []SDRSensorConfig{{Name: "a", Model: "M", LearnMinutes: -1}}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkSDRSensors(test.sensors); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
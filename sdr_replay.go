@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SDRReplayConfig reads rtl_433 JSON lines from file instead of running rtl_433, with "-" being
+// stdin.  Pace sleeps between lines based on their time field so intervals work out like they
+// would have live, otherwise the whole thing goes as fast as it can.  A capture file from
+// another run is exactly what this wants.
+type SDRReplayConfig struct {
+	File string `yaml:"file"`
+	Pace bool   `yaml:"pace"`
+}
+
+// rtl_433 time formats, depending on what -M time was set to
+var rtl433TimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.999999",
+	time.RFC3339,
+}
+
+func (cfg *SDRReplayConfig) check() error {
+	if cfg.File == "-" {
+		return nil
+	}
+	_, err := os.Stat(cfg.File)
+	return err
+}
+
+//
+// received is where every line from rtl_433 or a replay ends up.  It returns false if the
+// module is stopping.
+//
+func (sdr *sdrData) received(line []byte) bool {
+	sdr.health.Beat()
+
+	if sdr.capture != nil {
+		if _, err := sdr.capture.Write(append(line, '\n')); err != nil {
+			log.Debugf("%s: capture: %v", sdr.name, err)
+		}
+	}
+
+	select {
+	case sdr.dataChan <- line:
+		return true
+	case <-sdr.scope.Done():
+		return false
+	}
+}
+
+// openCapture appends every line we hear to the capture file, until the module stops
+func (sdr *sdrData) openCapture() {
+	if len(sdr.sdrCfg.Capture) == 0 {
+		return
+	}
+
+	file, err := os.OpenFile(sdr.sdrCfg.Capture, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Errorf("%s: capture: %v", sdr.name, err)
+		return
+	}
+	sdr.capture = file
+	sdr.scope.OnStop(func() { file.Close() })
+}
+
+//
+// runReplay is runRTL433 for when the data is coming from a file
+//
+func (sdr *sdrData) runReplay() {
+	var in io.Reader = os.Stdin
+	if sdr.sdrCfg.Replay.File != "-" {
+		file, err := os.Open(sdr.sdrCfg.Replay.File)
+		if err != nil {
+			log.Errorf("%s: replay: %v", sdr.name, err)
+			sdr.health.Error(err)
+			return
+		}
+		// Closing it is also how a stop gets us out of a read
+		sdr.scope.OnStop(func() { file.Close() })
+		in = file
+	}
+
+	log.Infof("%s: replay: %s", sdr.name, sdr.sdrCfg.Replay.File)
+
+	var last time.Time
+	lines := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := []byte(scanner.Text())
+
+		if sdr.sdrCfg.Replay.Pace {
+			if when, ok := replayTime(line); ok {
+				if gap := when.Sub(last); !last.IsZero() && gap > 0 {
+					select {
+					case <-time.After(gap):
+					case <-sdr.scope.Done():
+						return
+					}
+				}
+				last = when
+			}
+		}
+
+		if !sdr.received(line) {
+			return
+		}
+		lines++
+	}
+
+	select {
+	case <-sdr.scope.Done():
+		return
+	default:
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("%s: replay: %v", sdr.name, err)
+		sdr.health.Error(err)
+		return
+	}
+	log.Infof("%s: replay: done after %d lines", sdr.name, lines)
+}
+
+// replayTime pulls the time out of a line, which is either a date or unix seconds
+func replayTime(line []byte) (time.Time, bool) {
+	var packet struct {
+		Time interface{} `json:"time"`
+	}
+	if err := json.Unmarshal(line, &packet); err != nil {
+		return time.Time{}, false
+	}
+
+	switch t := packet.Time.(type) {
+	case float64:
+		return unixTime(t), true
+	case string:
+		for _, layout := range rtl433TimeLayouts {
+			if when, err := time.ParseInLocation(layout, t, time.Local); err == nil {
+				return when, true
+			}
+		}
+		if secs, err := strconv.ParseFloat(t, 64); err == nil {
+			return unixTime(secs), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayTime(t *testing.T) {
+	local := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+
+	tests := []struct {
+		name string
+		line string
+		want time.Time
+		ok   bool
+	}{
+		{"default", `{"time": "2024-01-02 03:04:05"}`, local, true},
+		{"usec", `{"time": "2024-01-02 03:04:05.250000"}`, local.Add(250 * time.Millisecond), true},
+		{"iso", `{"time": "2024-01-02T03:04:05"}`, local, true},
+		{"iso usec", `{"time": "2024-01-02T03:04:05.5"}`, local.Add(500 * time.Millisecond), true},
+		{"rfc3339", `{"time": "2024-01-02T03:04:05Z"}`, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), true},
+		{"unix", `{"time": 1700000000.5}`, time.Unix(1700000000, 5e8), true},
+		{"unix string", `{"time": "1700000000"}`, time.Unix(1700000000, 0), true},
+		{"no time", `{"model": "x"}`, time.Time{}, false},
+		{"bad time", `{"time": "yesterday"}`, time.Time{}, false},
+		{"not json", `time=now`, time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := replayTime([]byte(test.line))
+		if ok != test.ok {
+			t.Errorf("%s: ok %v", test.name, ok)
+			continue
+		}
+		if ok && !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RTL433Config is how rtl_433 gets run.  Device is the -d index or :serial (or a SoapySDR
+// string), and frequency is one or more frequencies like 433.92M, hopping between them every
+// hopSeconds.  SampleRate takes the same suffixes, gain is in dB with 0 being auto, and ppm is
+// the dongle's frequency correction.  ConfigFile is passed to rtl_433 first, so anything set
+// here wins.
+type RTL433Config struct {
+	App        string           `yaml:"app"`
+	ConfigFile string           `yaml:"configFile"`
+	Device     string           `yaml:"device"`
+	Frequency  SDRFrequencyList `yaml:"frequency"`
+	HopSeconds int              `yaml:"hopSeconds"`
+	SampleRate string           `yaml:"sampleRate"`
+	Gain       string           `yaml:"gain"`
+	PPM        int              `yaml:"ppm"`
+	Protocols  []int            `yaml:"protocols"`
+	OnTime     int              `yaml:"onSeconds"`
+	OffTime    int              `yaml:"offSeconds"`
+	Deadman    int              `yaml:"deadman"`
+}
+
+// SDRFrequencyList takes either a single frequency or a list of them
+type SDRFrequencyList []string
+
+func (list *SDRFrequencyList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var one string
+	if err := unmarshal(&one); err == nil {
+		*list = SDRFrequencyList{one}
+		return nil
+	}
+
+	var many []string
+	if err := unmarshal(&many); err != nil {
+		return err
+	}
+	*list = many
+	return nil
+}
+
+//
+// What an RTL2832 dongle can actually do.  Anything going through SoapySDR is somebody else's
+// problem.
+//
+const (
+	rtlMinFrequency  = 24e6
+	rtlMaxFrequency  = 1766e6
+	rtlMaxSampleRate = 3.2e6
+	rtlMaxGain       = 50
+	rtlMaxPPM        = 1000
+)
+
+func (cfg *RTL433Config) args() []string {
+	// -M level adds rssi, snr and noise to everything for the diagnostics
+	args := []string{"-F", "json", "-C", "si", "-M", "level"}
+
+	if len(cfg.ConfigFile) > 0 {
+		args = append(args, "-c", cfg.ConfigFile)
+	}
+
+	if len(cfg.Device) > 0 {
+		args = append(args, "-d", cfg.Device)
+	}
+
+	for _, frequency := range cfg.Frequency {
+		args = append(args, "-f", frequency)
+	}
+
+	if cfg.HopSeconds > 0 {
+		args = append(args, "-H", strconv.Itoa(cfg.HopSeconds))
+	}
+
+	if len(cfg.SampleRate) > 0 {
+		args = append(args, "-s", cfg.SampleRate)
+	}
+
+	if len(cfg.Gain) > 0 {
+		args = append(args, "-g", cfg.Gain)
+	}
+
+	if cfg.PPM != 0 {
+		args = append(args, "-p", strconv.Itoa(cfg.PPM))
+	}
+
+	if cfg.OnTime > 0 {
+		args = append(args, "-T", strconv.Itoa(cfg.OnTime))
+	}
+
+	for _, protocol := range cfg.Protocols {
+		args = append(args, "-R", strconv.Itoa(protocol))
+	}
+
+	return args
+}
+
+// check catches the settings rtl_433 would choke on, or worse, quietly ignore
+func (cfg *RTL433Config) check() error {
+	soapy := strings.Contains(cfg.Device, "=")
+
+	if len(cfg.Device) > 0 && !soapy && !strings.HasPrefix(cfg.Device, ":") && !strings.HasPrefix(cfg.Device, "rtl_tcp") {
+		if _, err := strconv.Atoi(cfg.Device); err != nil {
+			return fmt.Errorf("device %s is not an index, :serial, rtl_tcp or SoapySDR string", cfg.Device)
+		}
+	}
+
+	for _, frequency := range cfg.Frequency {
+		hz, err := parseSI(frequency)
+		if err != nil {
+			return fmt.Errorf("frequency: %v", err)
+		}
+		if !soapy && (hz < rtlMinFrequency || hz > rtlMaxFrequency) {
+			return fmt.Errorf("frequency %s is out of range", frequency)
+		}
+	}
+
+	if cfg.HopSeconds < 0 {
+		return errors.New("hopSeconds can't be negative")
+	}
+	if cfg.HopSeconds > 0 && len(cfg.Frequency) < 2 {
+		return errors.New("hopSeconds needs more than one frequency")
+	}
+
+	if len(cfg.SampleRate) > 0 {
+		rate, err := parseSI(cfg.SampleRate)
+		if err != nil {
+			return fmt.Errorf("sampleRate: %v", err)
+		}
+		// The RTL2832 has a hole between the two ranges it supports
+		if !soapy && (rate <= 225e3 || (rate > 300e3 && rate <= 900e3) || rate > rtlMaxSampleRate) {
+			return fmt.Errorf("sampleRate %s is out of range", cfg.SampleRate)
+		}
+	}
+
+	if len(cfg.Gain) > 0 && !soapy {
+		gain, err := strconv.ParseFloat(cfg.Gain, 64)
+		if err != nil || gain < 0 || gain > rtlMaxGain {
+			return fmt.Errorf("gain %s should be 0 (auto) to %d dB", cfg.Gain, rtlMaxGain)
+		}
+	}
+
+	if cfg.PPM < -rtlMaxPPM || cfg.PPM > rtlMaxPPM {
+		return fmt.Errorf("ppm %d is out of range", cfg.PPM)
+	}
+
+	for _, protocol := range cfg.Protocols {
+		if protocol == 0 {
+			return errors.New("protocol 0 doesn't exist")
+		}
+	}
+
+	if cfg.OnTime < 0 || cfg.OffTime < 0 || cfg.Deadman < 0 {
+		return errors.New("onSeconds, offSeconds and deadman can't be negative")
+	}
+
+	if len(cfg.ConfigFile) > 0 {
+		if _, err := os.Stat(cfg.ConfigFile); err != nil {
+			return fmt.Errorf("configFile: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// parseSI reads numbers like rtl_433 does, so 433.92M, 250k and 915000000 all work
+func parseSI(value string) (float64, error) {
+	number := value
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier = 1e3
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1e6
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		number = value[:len(value)-1]
+	}
+
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("bad value %s", value)
+	}
+	return v * multiplier, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseSI(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"433.92M", 433.92e6, true},
+		{"915000000", 915e6, true},
+		{"250k", 250e3, true},
+		{"250K", 250e3, true},
+		{"1.024G", 1.024e9, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"433.92MHz", 0, false},
+		{"-433M", 0, false},
+		{"0", 0, false},
+		{"lots", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseSI(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got %v", test.in, err)
+			continue
+		}
+		// Allow for the float math in the multiplier
+		if test.ok && (got < test.want*0.999999 || got > test.want*1.000001) {
+			t.Errorf("%q: got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRTL433Check(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  RTL433Config
+		ok   bool
+	}{
+		{"empty", RTL433Config{}, true},
+		{"index", RTL433Config{Device: "1"}, true},
+		{"serial", RTL433Config{Device: ":00000915"}, true},
+		{"rtl_tcp", RTL433Config{Device: "rtl_tcp:192.168.1.2"}, true},
+		{"soapy", RTL433Config{Device: "driver=lime", Frequency: SDRFrequencyList{"2.4G"}}, true},
+		{"bad device", RTL433Config{Device: "usb0"}, false},
+		{"frequency", RTL433Config{Frequency: SDRFrequencyList{"433.92M", "315M"}}, true},
+		{"frequency too low", RTL433Config{Frequency: SDRFrequencyList{"10M"}}, false},
+		{"frequency too high", RTL433Config{Frequency: SDRFrequencyList{"2.4G"}}, false},
+		{"frequency typo", RTL433Config{Frequency: SDRFrequencyList{"433.92Mhz"}}, false},
+		{"hop", RTL433Config{Frequency: SDRFrequencyList{"433.92M", "315M"}, HopSeconds: 60}, true},
+		{"hop with one frequency", RTL433Config{Frequency: SDRFrequencyList{"433.92M"}, HopSeconds: 60}, false},
+		{"negative hop", RTL433Config{HopSeconds: -1}, false},
+		{"sample rate", RTL433Config{SampleRate: "1024k"}, true},
+		{"sample rate in the hole", RTL433Config{SampleRate: "500k"}, false},
+		{"sample rate too high", RTL433Config{SampleRate: "3.3M"}, false},
+		{"auto gain", RTL433Config{Gain: "0"}, true},
+		{"gain", RTL433Config{Gain: "40"}, true},
+		{"gain too high", RTL433Config{Gain: "60"}, false},
+		{"gain not a number", RTL433Config{Gain: "max"}, false},
+		{"soapy gain", RTL433Config{Device: "driver=lime", Gain: "LNA=20"}, true},
+		{"ppm", RTL433Config{PPM: -20}, true},
+		{"ppm too big", RTL433Config{PPM: 2000}, false},
+		{"protocol 0", RTL433Config{Protocols: []int{40, 0}}, false},
+		{"negative on time", RTL433Config{OnTime: -1}, false},
+		{"missing config file", RTL433Config{ConfigFile: "/nonexistent/rtl_433.conf"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.cfg.check(); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestSDRFrequencyList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want SDRFrequencyList
+	}{
+		{`frequency: "433.92M"`, SDRFrequencyList{"433.92M"}},
+		{`frequency: ["433.92M", "315M"]`, SDRFrequencyList{"433.92M", "315M"}},
+	}
+
+	for _, test := range tests {
+		var cfg RTL433Config
+		if err := yaml.Unmarshal([]byte(test.in), &cfg); err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Frequency, test.want) {
+			t.Errorf("%s: got %v", test.in, cfg.Frequency)
+		}
+	}
+}
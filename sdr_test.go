@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v2"
+)
+
+// recordingBrokerMux keeps everything published through it, for tests that care what went out
+type recordingBrokerMux struct {
+	published chan recordedPublish
+}
+
+type recordedPublish struct {
+	topic   string
+	payload string
+}
+
+func newRecordingBrokerMux() *recordingBrokerMux {
+	return &recordingBrokerMux{published: make(chan recordedPublish, 64)}
+}
+
+func (mux *recordingBrokerMux) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var out string
+	switch p := payload.(type) {
+	case []byte:
+		out = string(p)
+	case string:
+		out = p
+	}
+	mux.published <- recordedPublish{topic: topic, payload: out}
+	return newErrorToken("recorded")
+}
+
+func (mux *recordingBrokerMux) Subscribe(topic string, qos byte, callback func(client mqtt.Client, msg mqtt.Message)) mqtt.Token {
+	return newErrorToken("recorded")
+}
+
+func (mux *recordingBrokerMux) Scope() ScopedBrokerMux {
+	return mux
+}
+
+func (mux *recordingBrokerMux) Close() {
+}
+
+// next is the next thing published, which SDR does from its own goroutines
+func (mux *recordingBrokerMux) next(t *testing.T) recordedPublish {
+	t.Helper()
+	select {
+	case p := <-mux.published:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("nothing published")
+	}
+	return recordedPublish{}
+}
+
+func (mux *recordingBrokerMux) none(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-mux.published:
+		t.Fatalf("published %s: %s", p.topic, p.payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// newTestSDR is initSDR without rtl_433, the main loop or anything else that runs on its own
+func newTestSDR(cfg *SDRConfig) (*sdrData, *recordingBrokerMux) {
+	mux := newRecordingBrokerMux()
+	sdr := &sdrData{
+		sdrCfg:     cfg,
+		name:       "sdr",
+		scope:      newModuleScope(mux, "sdr"),
+		sensors:    make(map[string]*sdrSensor),
+		logicals:   newSDRLogicals(cfg.Sensors),
+		discovered: make(map[string]*sdrDiscovery),
+		allowMap:   make(map[string]bool),
+	}
+	for _, allow := range cfg.Allow {
+		sdr.addAllowedSensor(allow.Model, allow.ID)
+	}
+	return sdr, mux
+}
+
+// testSDRConfig is easier to read as YAML, and the allow list is an anonymous struct anyway
+func testSDRConfig(t *testing.T, in string) *SDRConfig {
+	t.Helper()
+	var cfg SDRConfig
+	if err := yaml.Unmarshal([]byte(in), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func testPayload(t *testing.T, p recordedPublish) map[string]interface{} {
+	t.Helper()
+	var out map[string]interface{}
+	if err := json.Unmarshal([]byte(p.payload), &out); err != nil {
+		t.Fatalf("%s: %v", p.payload, err)
+	}
+	return out
+}
+
+func TestSDRAllowList(t *testing.T) {
+	cfg := testSDRConfig(t, `
+topic: "local:sensors/"
+allow:
+  - model: "Acurite-Tower"
+    id: 1
+`)
+	sdr, mux := newTestSDR(cfg)
+
+	sdr.consume([]byte(`{"model": "Acurite-Tower", "id": 2, "temperature_C": 20}`))
+	sdr.consume([]byte(`{"model": "LaCrosse-TX141", "id": 1, "temperature_C": 20}`))
+	sdr.consume([]byte(`{"model": "Acurite-Tower", "id": 1, "temperature_C": 21.5}`))
+	sdr.emit()
+
+	p := mux.next(t)
+	if p.topic != "local:sensors/1" {
+		t.Errorf("got %s", p.topic)
+	}
+	mux.none(t)
+
+	// Everything else went to discovery instead
+	if len(sdr.discovered) != 0 {
+		t.Errorf("discovered %d without a discovery topic", len(sdr.discovered))
+	}
+	cfg.Discovery.Topic = "local:sensors/discovered"
+	sdr.consume([]byte(`{"model": "Acurite-Tower", "id": 2, "temperature_C": 20}`))
+	if len(sdr.discovered) != 1 {
+		t.Errorf("discovered %d", len(sdr.discovered))
+	}
+}
+
+func TestSDRUnits(t *testing.T) {
+	tests := []struct {
+		name   string
+		models []SDRModelConfig
+		packet string
+		want   map[string]interface{}
+	}{
+		{
+			"default celsius",
+			nil,
+			`{"model": "x", "id": 1, "temperature_C": 21.5, "humidity": 40}`,
+			map[string]interface{}{"temperature": 21.5, "humidity": 40.0},
+		},
+		{
+			"default fahrenheit",
+			nil,
+			`{"model": "x", "id": 1, "temperature_F": 212}`,
+			map[string]interface{}{"temperature": 100.0},
+		},
+		{
+			"string number",
+			[]SDRModelConfig{{Model: "*", Fields: []SDRFieldMapping{{Source: "pressure_kPa", Output: "pressure", Convert: "kpa_to_hpa"}}}},
+			`{"model": "x", "id": 1, "pressure_kPa": "101.3"}`,
+			map[string]interface{}{"pressure": 1013.0},
+		},
+		{
+			"wind",
+			[]SDRModelConfig{{Model: "*", Fields: []SDRFieldMapping{{Source: "wind_avg_m_s", Output: "windSpeed", Convert: "ms_to_kmh"}}}},
+			`{"model": "x", "id": 1, "wind_avg_m_s": 2.5}`,
+			map[string]interface{}{"windSpeed": 9.0},
+		},
+	}
+
+	for _, test := range tests {
+		sdr, mux := newTestSDR(&SDRConfig{Topic: "local:sensors/", Models: test.models})
+		sdr.consume([]byte(test.packet))
+		sdr.emit()
+
+		if got := testPayload(t, mux.next(t)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSDREmitTiming(t *testing.T) {
+	sdr, mux := newTestSDR(&SDRConfig{Topic: "local:sensors/"})
+
+	// Nothing heard, nothing published
+	sdr.emit()
+	mux.none(t)
+
+	// Not until there's a temperature, which the defaults require
+	sdr.consume([]byte(`{"model": "x", "id": 1, "humidity": 40}`))
+	sdr.emit()
+	mux.none(t)
+
+	// Everything in the interval goes out once, as the last reading
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 20}`))
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 21}`))
+	mux.none(t)
+	sdr.emit()
+	if got := testPayload(t, mux.next(t)); got["temperature"] != 21.0 {
+		t.Errorf("got %v", got)
+	}
+
+	// And not again until something new shows up
+	sdr.emit()
+	mux.none(t)
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 21}`))
+	sdr.emit()
+	mux.next(t)
+}
+
+func TestSDRConsumeJunk(t *testing.T) {
+	sdr, mux := newTestSDR(&SDRConfig{Topic: "local:sensors/"})
+
+	for _, line := range []string{
+		`not json`,
+		`{"id": 1, "temperature_C": 20}`,
+		`{"model": "x", "temperature_C": 20}`,
+		`{"model": "x", "id": "one", "temperature_C": 20}`,
+	} {
+		sdr.consume([]byte(line))
+	}
+	sdr.emit()
+	mux.none(t)
+
+	if len(sdr.sensors) != 0 {
+		t.Errorf("got %d sensors", len(sdr.sensors))
+	}
+}
+
+func testDeadbandSensor(model *SDRModelConfig, published map[string]interface{}, age time.Duration, raw map[string]interface{}) *sdrSensor {
+	sensor := newSDRSensor("M", 1, "1", model)
+	sensor.published = published
+	sensor.publishedTime = time.Now().Add(-age)
+	sensor.update(raw)
+	return sensor
+}
+
+func TestSDRSuppressed(t *testing.T) {
+	model := &SDRModelConfig{
+		Fields: []SDRFieldMapping{
+			{Source: "temperature_C", Output: "temperature", Deadband: 0.5},
+			{Source: "humidity", Output: "humidity"},
+		},
+		Passthrough:      true,
+		HeartbeatMinutes: 60,
+	}
+	published := map[string]interface{}{"temperature": 20.0, "humidity": 50.0, "levels": []interface{}{1.0, 2.0}}
+
+	tests := []struct {
+		name       string
+		heartbeat  int
+		age        time.Duration
+		raw        map[string]interface{}
+		suppressed bool
+	}{
+		{"same", 60, time.Minute, map[string]interface{}{"temperature_C": 20.0, "humidity": 50.0}, true},
+		{"inside deadband", 60, time.Minute, map[string]interface{}{"temperature_C": 20.4}, true},
+		{"past deadband", 60, time.Minute, map[string]interface{}{"temperature_C": 20.5}, false},
+		{"no deadband", 60, time.Minute, map[string]interface{}{"humidity": 51.0}, false},
+		{"new field", 60, time.Minute, map[string]interface{}{"battery_ok": 1.0}, false},
+		{"same list", 60, time.Minute, map[string]interface{}{"levels": []interface{}{1.0, 2.0}}, true},
+		{"different list", 60, time.Minute, map[string]interface{}{"levels": []interface{}{1.0, 3.0}}, false},
+		{"heartbeat due", 60, 61 * time.Minute, map[string]interface{}{"temperature_C": 20.0}, false},
+		{"no heartbeat", 0, time.Minute, map[string]interface{}{"temperature_C": 20.0}, false},
+	}
+
+	for _, test := range tests {
+		m := *model
+		m.HeartbeatMinutes = test.heartbeat
+		sensor := testDeadbandSensor(&m, published, test.age, test.raw)
+		if got := sensor.suppressed(); got != test.suppressed {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
+
+func TestSDRPastDeadband(t *testing.T) {
+	model := &SDRModelConfig{
+		Fields: []SDRFieldMapping{
+			{Source: "temperature_C", Output: "temperature", Deadband: 0.5},
+			{Source: "humidity", Output: "humidity"},
+		},
+		Require: []string{"temperature"},
+	}
+	published := map[string]interface{}{"temperature": 20.0, "humidity": 50.0}
+
+	tests := []struct {
+		name      string
+		published map[string]interface{}
+		raw       map[string]interface{}
+		past      bool
+	}{
+		{"up", published, map[string]interface{}{"temperature_C": 20.6}, true},
+		{"down", published, map[string]interface{}{"temperature_C": 19.5}, true},
+		{"inside", published, map[string]interface{}{"temperature_C": 20.4}, false},
+		{"no deadband", published, map[string]interface{}{"temperature_C": 20.0, "humidity": 90.0}, false},
+		{"never published", nil, map[string]interface{}{"temperature_C": 30.0}, false},
+		{"not ready", published, map[string]interface{}{"humidity": 90.0}, false},
+	}
+
+	for _, test := range tests {
+		sensor := testDeadbandSensor(model, test.published, time.Minute, test.raw)
+		if got := sensor.pastDeadband(); got != test.past {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
+
+func TestSDRDeadbandPublishesEarly(t *testing.T) {
+	sdr, mux := newTestSDR(testSDRConfig(t, `
+topic: "local:sensors/"
+models:
+  - model: "*"
+    fields:
+      - source: "temperature_C"
+        output: "temperature"
+        deadband: 1
+`))
+
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 20}`))
+	sdr.emit()
+	mux.next(t)
+
+	// Small changes wait for the interval, big ones don't
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 20.5}`))
+	mux.none(t)
+	sdr.consume([]byte(`{"model": "x", "id": 1, "temperature_C": 22}`))
+	if got := testPayload(t, mux.next(t)); got["temperature"] != 22.0 {
+		t.Errorf("got %v", got)
+	}
+
+	// It already went out, so there's nothing left for the interval
+	sdr.emit()
+	mux.none(t)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"math/rand"
+	"strings"
 )
 
 // StringsConfig supports a list of Strings to publish to a topic. One will be randomly selected at every offset.
@@ -11,14 +12,14 @@ type StringsConfig struct {
 	Strings []string     `yaml:"strings"`
 }
 
-func initStrings(bmux BrokerMux, cfg StringsConfig) {
+func initStrings(scope *moduleScope, mmux MatrixMux, cfg StringsConfig) {
 	if len(cfg.Topic) > 0 && len(cfg.Strings) > 0 {
-		NewJobRunner("strings", cfg.Jobs, func() {
+		scope.NewJobRunner("strings", cfg.Jobs, func() {
 			index := 0
 			if len(cfg.Strings) > 0 {
 				index = rand.Intn(len(cfg.Strings))
 			}
-			bmux.Publish(cfg.Topic, 0, false, cfg.Strings[index])
+			mmux.PublishText(cfg.Topic, strings.Split(cfg.Strings[index], ":"))
 		}).Run()
 	}
 }
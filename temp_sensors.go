@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
@@ -27,8 +28,9 @@ type tempSensorsImpl struct {
 	// How/when to report.  Probably should grab a pointer instead of a copy.
 	config []TempSensorConfig
 
-	// MQTT client to use to report
-	bmux BrokerMux
+	// Module we belong to, and the matrix to report to
+	scope *moduleScope
+	mmux  MatrixMux
 
 	// Actual temp sensor data
 	tempSensors map[string]*tempSensor
@@ -43,11 +45,12 @@ type tempSensorsImpl struct {
 //
 // Init
 //
-func initTempSensors(bmux BrokerMux, cfgs []TempSensorConfig) {
+func initTempSensors(scope *moduleScope, mmux MatrixMux, cfgs []TempSensorConfig) {
 
 	// Create the basic struct
 	impl := &tempSensorsImpl{
-		bmux:        bmux,
+		scope:       scope,
+		mmux:        mmux,
 		config:      cfgs,
 		tempChan:    make(chan mqtt.Message),
 		runChan:     make(chan int),
@@ -64,8 +67,11 @@ func initTempSensors(bmux BrokerMux, cfgs []TempSensorConfig) {
 
 		// Create the runner, creating a copy of the groupIdx for the closure
 		idx := groupIdx
-		runner := NewJobRunner("sensors-"+strconv.Itoa(groupIdx), group.Jobs, func() {
-			impl.runChan <- idx
+		runner := scope.NewJobRunner("sensors-"+strconv.Itoa(groupIdx), group.Jobs, func() {
+			select {
+			case impl.runChan <- idx:
+			case <-scope.Done():
+			}
 		})
 		runners = append(runners, runner)
 
@@ -78,8 +84,13 @@ func initTempSensors(bmux BrokerMux, cfgs []TempSensorConfig) {
 				name:  sensorCfg.Name,
 				dirty: false,
 			}
+			if old, ok := impl.tempSensors[sensorCfg.Sub]; ok {
+				sensor.health = old.health
+			} else {
+				sensor.health = scope.Health("sensor-"+sensorCfg.Name, tempSensorMaxAge)
+			}
 
-			t := bmux.Subscribe(sensorCfg.Sub, 0, func(client mqtt.Client, msg mqtt.Message) {
+			t := scope.Subscribe(sensorCfg.Sub, 0, func(client mqtt.Client, msg mqtt.Message) {
 				impl.HandleTempMessage(msg)
 			})
 			t.Wait()
@@ -116,8 +127,12 @@ type tempSensor struct {
 	lastTemp     float32
 	lastHumidity float32
 	dirty        bool
+	health       *healthEntry
 }
 
+// Sensors that haven't reported in this long show up as stale
+const tempSensorMaxAge = time.Hour
+
 // Parse a message and mark as dirty
 func (s *tempSensor) processMessage(msg []byte) {
 	var cooked tempSensorData
@@ -161,12 +176,17 @@ func (d *tempSensorsImpl) loop() {
 			d.processTemp(msg.Topic(), msg.Payload())
 		case idx := <-d.runChan:
 			d.processGroup(idx)
+		case <-d.scope.Done():
+			return
 		}
 	}
 }
 
 func (d *tempSensorsImpl) HandleTempMessage(msg mqtt.Message) {
-	d.tempChan <- msg
+	select {
+	case d.tempChan <- msg:
+	case <-d.scope.Done():
+	}
 }
 
 func (d *tempSensorsImpl) processTemp(topic string, payload []byte) {
@@ -180,8 +200,10 @@ func (d *tempSensorsImpl) processTemp(topic string, payload []byte) {
 			sensor.lastTemp = (data.Temperature*9)/5 + 32
 			sensor.lastHumidity = data.Humidity
 			log.Debugf("sensors: processTemp: %s %.2f %.0f", topic, sensor.lastTemp, sensor.lastHumidity+0.5)
+			sensor.health.Success()
 		} else {
 			log.Errorf("sensors: processTemp: error=%s", err.Error())
+			sensor.health.Error(err)
 		}
 	}
 }
@@ -195,25 +217,23 @@ func (d *tempSensorsImpl) processGroup(index int) {
 
 	group := &d.config[index]
 	pubTopic := group.Topic
-	event := ""
+	lines := make([]string, 0, len(group.Sensors))
 
 	// Walk the sensors in the group and create a message with all of the dirty ones
 	for _, desc := range group.Sensors {
 		if sensor, ok := d.tempSensors[desc.Sub]; ok == true {
 			if sensor.isDirty() {
-				if len(event) > 0 {
-					event = event + ":"
-				}
-				event = event + fmt.Sprintf("%s is %.1f\xB0", sensor.name, sensor.lastTemp)
+				line := fmt.Sprintf("%s is %.1f\xB0", sensor.name, sensor.lastTemp)
 				if sensor.lastHumidity > 0 {
-					event = event + fmt.Sprintf(" / %.0f%%", sensor.lastHumidity+0.5)
+					line = line + fmt.Sprintf(" / %.0f%%", sensor.lastHumidity+0.5)
 				}
+				lines = append(lines, line)
 			}
 		}
 	}
 
-	if len(event) > 0 {
-		log.Infof("sensors: event: %s", event)
-		go d.bmux.Publish(pubTopic, 0, false, event)
+	if len(lines) > 0 {
+		log.Infof("sensors: event: %v", lines)
+		go d.mmux.PublishText(pubTopic, lines)
 	}
 }
@@ -19,7 +19,7 @@ type WeatherConfig struct {
 	} `yaml:"locations"`
 }
 
-func initWeather(bmux BrokerMux, cfg WeatherConfig) {
+func initWeather(scope *moduleScope, mmux MatrixMux, cfg WeatherConfig) {
 	if len(cfg.Topic) <= 0 {
 		return
 	}
@@ -30,8 +30,13 @@ func initWeather(bmux BrokerMux, cfg WeatherConfig) {
 
 	for _, location := range cfg.Locations {
 		zipcode := location.Zipcode
-		NewJobRunner("weather"+"-"+location.Zipcode, location.Jobs, func() {
-			reportWeather(bmux, cfg.Topic, cfg.Key, zipcode)
+		health := scope.Health("weather-"+zipcode, 0)
+		scope.NewJobRunner("weather"+"-"+location.Zipcode, location.Jobs, func() {
+			err := reportWeather(mmux, cfg.Topic, cfg.Key, zipcode)
+			if err != nil {
+				log.Errorf("weather: %v", err)
+			}
+			health.Result(err)
 		}).Run()
 	}
 }
@@ -51,7 +56,7 @@ type weatherData struct {
 	} `json:"wind"`
 }
 
-func reportWeather(bmux BrokerMux, topic string, key string, zipcode string) {
+func reportWeather(mmux MatrixMux, topic string, key string, zipcode string) error {
 	var myClient = &http.Client{Timeout: 10 * time.Second}
 	var myResp weatherData
 
@@ -61,14 +66,12 @@ func reportWeather(bmux BrokerMux, topic string, key string, zipcode string) {
 	uri := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?zip=%s&APPID=%s&units=imperial", zipcode, key)
 	rawResp, err := myClient.Get(uri)
 	if err != nil {
-		log.Errorf("weather: GET error: %s", err.Error())
-		return
+		return fmt.Errorf("GET error: %s", err.Error())
 	}
 	defer rawResp.Body.Close()
 
 	if rawResp.StatusCode != http.StatusOK {
-		log.Errorf("weather: GET bad response: %d", rawResp.StatusCode)
-		return
+		return fmt.Errorf("GET bad response: %d", rawResp.StatusCode)
 	}
 
 	//
@@ -76,8 +79,7 @@ func reportWeather(bmux BrokerMux, topic string, key string, zipcode string) {
 	//
 	err = json.NewDecoder(rawResp.Body).Decode(&myResp)
 	if err != nil {
-		log.Errorf("weather: parse error: %s", err.Error())
-		return
+		return fmt.Errorf("parse error: %s", err.Error())
 	}
 
 	//
@@ -100,5 +102,6 @@ func reportWeather(bmux BrokerMux, topic string, key string, zipcode string) {
 	// Publish it
 	//
 	log.Infof("weather: %s", event)
-	bmux.Publish(topic, 0, false, event)
+	mmux.PublishText(topic, []string{event})
+	return nil
 }